@@ -0,0 +1,501 @@
+package activitypublog
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	activityStreamsPublic  = "https://www.w3.org/ns/activitystreams#Public"
+	activityJsonType       = "application/activity+json"
+)
+
+// インスタンスアクターの鍵の行のid
+const instanceActorId = "main"
+
+// インスタンスアクターのWebFingerでのユーザー名
+const instanceActorUsername = "activitypublog"
+
+func instanceActorUrl() string {
+	return os.Getenv("BASE_URL") + "/actor"
+}
+
+func instanceActorKeyId() string {
+	return instanceActorUrl() + "#main-key"
+}
+
+var instanceActorKey struct {
+	sync.Mutex
+	key *rsa.PrivateKey
+}
+
+// インスタンスアクターの秘密鍵。なければ作って保存する
+func loadInstanceActorKey() (*rsa.PrivateKey, error) {
+	instanceActorKey.Lock()
+	defer instanceActorKey.Unlock()
+	if instanceActorKey.key != nil {
+		return instanceActorKey.key, nil
+	}
+	actor, ok, err := store.SelectInstanceActor()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate instance actor key: %v", err)
+		}
+		block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+		err = store.InsertInstanceActorIfNotExists(InstanceActor{Id: instanceActorId, PrivateKey: string(pem.EncodeToMemory(block)), CreatedAt: time.Now().UTC()})
+		if err != nil {
+			return nil, err
+		}
+		// 他のプロセスが先に作っていたらそちらを使う
+		if actor, ok, err = store.SelectInstanceActor(); err != nil || !ok {
+			return nil, fmt.Errorf("failed to load instance actor key: %v", err)
+		}
+	}
+	block, _ := pem.Decode([]byte(actor.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid instance actor key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid instance actor key: %v", err)
+	}
+	instanceActorKey.key = key
+	return key, nil
+}
+
+// /actorで返すインスタンスアクター。署名を検証するサーバーはここから公開鍵を取りに来る
+func instanceActorDocument() (map[string]interface{}, error) {
+	key, err := loadInstanceActorKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %v", err)
+	}
+	publicKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return map[string]interface{}{
+		"@context":                  []string{activityStreamsContext, "https://w3id.org/security/v1"},
+		"id":                        instanceActorUrl(),
+		"type":                      "Application",
+		"preferredUsername":         instanceActorUsername,
+		"name":                      "activitypublog",
+		"inbox":                     instanceActorUrl() + "/inbox",
+		"outbox":                    instanceActorUrl() + "/outbox",
+		"url":                       os.Getenv("BASE_URL") + "/",
+		"manuallyApprovesFollowers": true,
+		"publicKey": map[string]string{
+			"id":           instanceActorKeyId(),
+			"owner":        instanceActorUrl(),
+			"publicKeyPem": string(publicKeyPem),
+		},
+	}, nil
+}
+
+// draft-cavage-http-signaturesでGETリクエストに署名する
+func signRequest(req *http.Request, key *rsa.PrivateKey, keyId string) error {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("Date", date)
+	signingString := "(request-target): " + strings.ToLower(req.Method) + " " + req.URL.RequestURI() + "\n" +
+		"host: " + req.URL.Host + "\n" +
+		"date: " + date
+	digest := sha256.Sum256([]byte(signingString))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %v", err)
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="(request-target) host date",signature="%s"`, keyId, base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+func getActivityPub(ctx context.Context, u string, signed bool, v interface{}) error {
+	if _, err := checkRemoteUrl(u); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", activityJsonType+`, application/ld+json; profile="`+activityStreamsContext+`"`)
+	if signed {
+		key, err := loadInstanceActorKey()
+		if err != nil {
+			return err
+		}
+		if err := signRequest(req, key, instanceActorKeyId()); err != nil {
+			return err
+		}
+	}
+	_, err = remote.doJSON(ctx, req, "", v)
+	return err
+}
+
+// ActivityPubのオブジェクトを取得する。authorized fetchのサーバーが401/403を返したら、インスタンスアクターで署名して取り直す
+func hGetActivityPub(ctx context.Context, u string, v interface{}) error {
+	err := getActivityPub(ctx, u, false, v)
+	if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrForbidden) {
+		err = getActivityPub(ctx, u, true, v)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to GET %s: %w", u, err)
+	}
+	return nil
+}
+
+// 文字列のことも、オブジェクトや配列のこともあるプロパティ
+type apValue json.RawMessage
+
+func (v *apValue) UnmarshalJSON(data []byte) error {
+	*v = append((*v)[0:0], data...)
+	return nil
+}
+
+// 中身がオブジェクトなら要素1つの配列として、配列ならそのまま返す
+func (v apValue) items() []json.RawMessage {
+	trimmed := strings.TrimSpace(string(v))
+	if trimmed == "" || trimmed == "null" {
+		return nil
+	}
+	if strings.HasPrefix(trimmed, "[") {
+		var items []json.RawMessage
+		if err := json.Unmarshal(v, &items); err != nil {
+			return nil
+		}
+		return items
+	}
+	return []json.RawMessage{json.RawMessage(v)}
+}
+
+// 文字列ならそれを、オブジェクトならidかhrefを返す。配列なら最初の要素
+func (v apValue) id() string {
+	for _, item := range v.items() {
+		var s string
+		if err := json.Unmarshal(item, &s); err == nil {
+			return s
+		}
+		var o struct {
+			Id   string
+			Href string
+		}
+		if err := json.Unmarshal(item, &o); err == nil {
+			if o.Id != "" {
+				return o.Id
+			}
+			return o.Href
+		}
+	}
+	return ""
+}
+
+func (v apValue) ids() []string {
+	var ids []string
+	for _, item := range v.items() {
+		if id := apValue(item).id(); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// 中身がオブジェクトのとき（文字列のURLでないとき）だけtrue
+func (v apValue) isObject() bool {
+	return strings.HasPrefix(strings.TrimSpace(string(v)), "{")
+}
+
+type apActor struct {
+	Id                string
+	Type              string
+	PreferredUsername string `json:"preferredUsername"`
+	Name              string
+	Url               apValue
+	Icon              apValue
+	Outbox            string
+	Followers         string
+}
+
+type apCollection struct {
+	Type         string
+	TotalItems   int `json:"totalItems"`
+	First        apValue
+	Next         apValue
+	OrderedItems []apValue `json:"orderedItems"`
+	Items        []apValue
+}
+
+type apActivity struct {
+	Id        string
+	Type      string
+	Actor     apValue
+	Object    apValue
+	Published string
+	To        apValue
+	Cc        apValue
+}
+
+type apNote struct {
+	Id           string
+	Type         string
+	Summary      string
+	Content      string
+	ContentMap   map[string]string `json:"contentMap"`
+	Url          apValue
+	Published    string
+	Updated      string
+	InReplyTo    apValue `json:"inReplyTo"`
+	AttributedTo apValue `json:"attributedTo"`
+	To           apValue
+	Cc           apValue
+	Sensitive    bool
+	Tag          apValue
+	Attachment   apValue
+}
+
+type apAttachment struct {
+	Type      string
+	MediaType string `json:"mediaType"`
+	Url       apValue
+	Name      string
+	Blurhash  string
+	Width     int
+	Height    int
+}
+
+var apUserNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// @user@hostをWebFingerで引き、actorを取得する
+func hGetActor(ctx context.Context, handle string) (apActor, error) {
+	var actor apActor
+	user, domain, ok := parseHandle(handle)
+	if !ok {
+		return actor, fmt.Errorf("invalid account: %s", handle)
+	}
+	actorUrl, err := hGetWebFingerActor(ctx, user, domain)
+	if err != nil {
+		return actor, err
+	}
+	if err := hGetActivityPub(ctx, actorUrl, &actor); err != nil {
+		return actor, err
+	}
+	if actor.Id == "" || actor.Outbox == "" {
+		return actor, fmt.Errorf("actor has no outbox: %s", actorUrl)
+	}
+	// ユーザー名は公開ページのパスやHTMLにそのまま入るので、使える文字を限る
+	if !apUserNamePattern.MatchString(actor.PreferredUsername) {
+		return actor, fmt.Errorf("invalid preferredUsername: %q", actor.PreferredUsername)
+	}
+	if err := checkSameOrigin(actorUrl, actor.Id); err != nil {
+		return actor, err
+	}
+	if err := checkSameOrigin(actor.Id, actor.Outbox); err != nil {
+		return actor, err
+	}
+	return actor, nil
+}
+
+// actorのサーバーにあるものだけを取得する。outboxのページやアクティビティはこれで取る
+func (actor apActor) fetch(ctx context.Context, u string, v interface{}) error {
+	if err := checkSameOrigin(actor.Id, u); err != nil {
+		return err
+	}
+	return hGetActivityPub(ctx, u, v)
+}
+
+func (c apCollection) activities() []apValue {
+	if len(c.OrderedItems) > 0 {
+		return c.OrderedItems
+	}
+	return c.Items
+}
+
+// MastodonやMisskeyのオブジェクトのURLは最後のパスがAPIのidになっている。ブーストのidは末尾に/activityが付く
+func statusIdFromUri(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Path == "" {
+		return uri
+	}
+	p := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/activity")
+	if id := path.Base(p); id != "." && id != "/" {
+		return id
+	}
+	return uri
+}
+
+func hostOf(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// 宛先から公開範囲を決める。outboxに出てくるのは普通publicかunlistedだけ
+func apVisibility(actor apActor, to []string, cc []string) string {
+	isPublic := func(ids []string) bool {
+		for _, id := range ids {
+			if id == activityStreamsPublic || id == "as:Public" || id == "Public" {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case isPublic(to):
+		return "public"
+	case isPublic(cc):
+		return "unlisted"
+	}
+	for _, id := range append(to, cc...) {
+		if id == actor.Followers {
+			return "private"
+		}
+	}
+	return "direct"
+}
+
+func (n apNote) toMediaAttachments(host string, statusId string) []MediaAttachment {
+	var media []MediaAttachment
+	for i, item := range n.Attachment.items() {
+		var a apAttachment
+		if err := json.Unmarshal(item, &a); err != nil {
+			continue
+		}
+		// アーカイブのoutbox.jsonでは/media_attachments/...のようなパスになっているので、サーバーのURLにする
+		remoteUrl := a.Url.id()
+		if strings.HasPrefix(remoteUrl, "/") && !strings.HasPrefix(remoteUrl, "//") {
+			remoteUrl = "https://" + host + remoteUrl
+		}
+		remoteUrl = httpUrlOrEmpty(remoteUrl)
+		if remoteUrl == "" {
+			continue
+		}
+		media = append(media, MediaAttachment{
+			// ActivityPubの添付にはidがないので、投稿のidと位置から作る
+			Id:          fmt.Sprintf("%s-%d", statusId, i),
+			Host:        host,
+			StatusId:    statusId,
+			Position:    i,
+			Type:        mediaTypeFromMimeType(a.MediaType),
+			Description: a.Name,
+			Blurhash:    a.Blurhash,
+			RemoteUrl:   remoteUrl,
+			Width:       a.Width,
+			Height:      a.Height,
+		})
+	}
+	return media
+}
+
+func (n apNote) tags() []Tag {
+	var tags []Tag
+	for _, item := range n.Tag.items() {
+		var t struct {
+			Type string
+			Name string
+		}
+		if err := json.Unmarshal(item, &t); err == nil && t.Type == "Hashtag" {
+			tags = append(tags, Tag{Name: strings.TrimPrefix(t.Name, "#")})
+		}
+	}
+	return tags
+}
+
+// Create/AnnounceのアクティビティをStatusにする。それ以外の種類や読めないものはokがfalse
+func (a apActivity) toStatus(actor apActor) (Status, bool) {
+	location, _ := time.LoadLocation("Asia/Tokyo")
+	host := hostOf(actor.Id)
+	switch a.Type {
+	case "Create":
+		if !a.Object.isObject() {
+			return Status{}, false
+		}
+		var note apNote
+		if err := json.Unmarshal(a.Object, &note); err != nil || note.Id == "" {
+			return Status{}, false
+		}
+		ca, err := time.Parse(time.RFC3339, note.Published)
+		if err != nil {
+			return Status{}, false
+		}
+		var ea time.Time
+		if note.Updated != "" {
+			ea, _ = time.Parse(time.RFC3339, note.Updated)
+		}
+		id := statusIdFromUri(note.Id)
+		var language string
+		for lang := range note.ContentMap {
+			language = lang
+			break
+		}
+		statusUrl := httpUrlOrEmpty(note.Url.id())
+		if statusUrl == "" {
+			statusUrl = httpUrlOrEmpty(note.Id)
+		}
+		// 自分への返信かどうかは、返信先が自分のactorの下にあるかでしか分からない
+		var inReplyToId, inReplyToAccountId string
+		if inReplyTo := note.InReplyTo.id(); inReplyTo != "" && hostOf(inReplyTo) == host {
+			inReplyToId = statusIdFromUri(inReplyTo)
+			if strings.HasPrefix(inReplyTo, actor.Id+"/") {
+				inReplyToAccountId = actor.Id
+			}
+		}
+		return Status{
+			Id:                 id,
+			Text:               htmlToText(note.Content),
+			Content:            note.Content,
+			SpoilerText:        note.Summary,
+			Sensitive:          note.Sensitive,
+			Language:           language,
+			Url:                statusUrl,
+			CreatedAt:          ca.In(location),
+			Tags:               note.tags(),
+			Host:               host,
+			AccountId:          actor.Id,
+			Visibility:         apVisibility(actor, note.To.ids(), note.Cc.ids()),
+			EditedAt:           ea,
+			InReplyToId:        inReplyToId,
+			InReplyToAccountId: inReplyToAccountId,
+			MediaAttachments:   note.toMediaAttachments(host, id),
+			Kind:               StatusKindPost,
+		}, true
+	case "Announce":
+		ca, err := time.Parse(time.RFC3339, a.Published)
+		if err != nil || a.Id == "" {
+			return Status{}, false
+		}
+		// ブーストした投稿は他のサーバーにあることが多いので、取りに行かずにURLだけ控える
+		objectUrl := httpUrlOrEmpty(a.Object.id())
+		return Status{
+			Id:          statusIdFromUri(a.Id),
+			Url:         objectUrl,
+			CreatedAt:   ca.In(location),
+			Host:        host,
+			AccountId:   actor.Id,
+			Visibility:  apVisibility(actor, a.To.ids(), a.Cc.ids()),
+			Kind:        StatusKindReblog,
+			ReblogOfUrl: objectUrl,
+		}, true
+	}
+	return Status{}, false
+}
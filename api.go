@@ -0,0 +1,302 @@
+package activitypublog
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// トークンだと分かるように付ける
+	personalAccessTokenPrefix = "apl_"
+	defaultApiPageLimit       = 40
+	maxApiPageLimit           = 200
+)
+
+// 新しいトークンを発行して保存する。戻り値のトークンはここでしか分からない
+func issuePersonalAccessToken(accountId string, host string, name string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	token := personalAccessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	err := store.InsertPersonalAccessToken(&PersonalAccessToken{
+		AccountId: accountId,
+		Host:      host,
+		Name:      name,
+		TokenHash: hashPersonalAccessToken(token),
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func hashPersonalAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiError(c echo.Context, status int, message string) error {
+	return c.JSON(status, map[string]string{"error": message})
+}
+
+// HandlerErrorのAPI版。ログインし直させる代わりにJSONでエラーを返す
+func ApiHandlerError(c echo.Context) func(error) error {
+	return func(err error) error {
+		fmt.Printf("error %s %s: %v\n", c.Request().Method, c.Path(), err)
+		return apiError(c, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// Authorization: Bearerのトークンからアカウントを決める。アカウントはapiAccountで取り出す
+func RequirePersonalAccessToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+		if !strings.HasPrefix(token, personalAccessTokenPrefix) {
+			return apiError(c, http.StatusUnauthorized, "missing bearer token")
+		}
+		pat, ok, err := store.SelectPersonalAccessTokenByHash(hashPersonalAccessToken(token))
+		if err != nil {
+			return ApiHandlerError(c)(err)
+		}
+		if !ok {
+			return apiError(c, http.StatusUnauthorized, "invalid token")
+		}
+		account, err := store.SelectAccount(pat.AccountId, pat.Host)
+		if err != nil {
+			return ApiHandlerError(c)(err)
+		}
+		// 使うたびに書き込まないよう、最終使用日時は1分単位で十分とする
+		if now := time.Now().UTC(); now.Sub(pat.LastUsedAt) > time.Minute {
+			if err := store.UpdatePersonalAccessTokenLastUsed(pat.Id, now); err != nil {
+				return ApiHandlerError(c)(err)
+			}
+		}
+		c.Set("account", account)
+		return next(c)
+	}
+}
+
+func apiAccount(c echo.Context) Account {
+	return c.Get("account").(Account)
+}
+
+// limitは省略時40、最大200
+func apiPageLimit(v string) (int, error) {
+	if v == "" {
+		return defaultApiPageLimit, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("limit must be a positive number")
+	}
+	if limit > maxApiPageLimit {
+		limit = maxApiPageLimit
+	}
+	return limit, nil
+}
+
+// カーソルは中身を気にせず次のリクエストにそのまま渡してもらう
+// 新しい順では最後の投稿のid、関連度順では読み飛ばす件数を入れる
+func encodeCursor(statusId string, offset int, relevance bool) string {
+	if relevance {
+		return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(statusId))
+}
+
+func decodeCursor(cursor string, relevance bool) (string, int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) == 0 {
+		return "", 0, fmt.Errorf("invalid cursor")
+	}
+	if relevance {
+		offset, err := strconv.Atoi(string(b))
+		if err != nil || offset < 0 {
+			return "", 0, fmt.Errorf("invalid cursor")
+		}
+		return "", offset, nil
+	}
+	return string(b), 0, nil
+}
+
+type ApiMediaAttachment struct {
+	Id          string `json:"id"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Blurhash    string `json:"blurhash"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	RemoteUrl   string `json:"remote_url"`
+	// 保存済みならこのサーバーのURL。未保存なら空
+	Url string `json:"url"`
+}
+
+type ApiStatus struct {
+	Id                 string               `json:"id"`
+	Url                string               `json:"url"`
+	CreatedAt          time.Time            `json:"created_at"`
+	EditedAt           *time.Time           `json:"edited_at"`
+	DeletedAt          *time.Time           `json:"deleted_at"`
+	Visibility         string               `json:"visibility"`
+	Kind               string               `json:"kind"`
+	Text               string               `json:"text"`
+	Content            string               `json:"content"`
+	SpoilerText        string               `json:"spoiler_text"`
+	Sensitive          bool                 `json:"sensitive"`
+	Language           string               `json:"language"`
+	InReplyToId        string               `json:"in_reply_to_id"`
+	InReplyToAccountId string               `json:"in_reply_to_account_id"`
+	ReblogOfId         string               `json:"reblog_of_id"`
+	ReblogOfUrl        string               `json:"reblog_of_url"`
+	ReblogAuthorAcct   string               `json:"reblog_author_acct"`
+	ReblogAuthorName   string               `json:"reblog_author_name"`
+	Tags               []string             `json:"tags"`
+	MediaAttachments   []ApiMediaAttachment `json:"media_attachments"`
+}
+
+type ApiAccount struct {
+	Id                  string `json:"id"`
+	Host                string `json:"host"`
+	UserName            string `json:"username"`
+	AllFetched          bool   `json:"all_fetched"`
+	Public              bool   `json:"public"`
+	ShowUnlisted        bool   `json:"show_unlisted"`
+	ShowPrivate         bool   `json:"show_private"`
+	ShowDirect          bool   `json:"show_direct"`
+	ShowReblogs         bool   `json:"show_reblogs"`
+	ShowDeleted         bool   `json:"show_deleted"`
+	SyncIntervalMinutes *int   `json:"sync_interval_minutes"`
+}
+
+// PATCHで変える項目。省略した項目はそのまま
+type ApiAccountUpdate struct {
+	Public              *bool `json:"public"`
+	ShowUnlisted        *bool `json:"show_unlisted"`
+	ShowPrivate         *bool `json:"show_private"`
+	ShowDirect          *bool `json:"show_direct"`
+	ShowReblogs         *bool `json:"show_reblogs"`
+	ShowDeleted         *bool `json:"show_deleted"`
+	SyncIntervalMinutes *int  `json:"sync_interval_minutes"`
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// メディアとタグを読み込んでAPIの形にする
+func toApiStatuses(statuses []Status, host string) ([]ApiStatus, error) {
+	statuses, err := attachMedia(statuses)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(statuses))
+	for _, s := range statuses {
+		ids = append(ids, s.Id)
+	}
+	tagNames, err := store.SelectTagNamesByStatuses(host, ids)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]ApiStatus, 0, len(statuses))
+	for _, s := range statuses {
+		media := make([]ApiMediaAttachment, 0, len(s.MediaAttachments))
+		for _, m := range s.MediaAttachments {
+			var mediaUrl string
+			if m.BlobKey != "" {
+				mediaUrl = os.Getenv("BASE_URL") + "/media/" + m.BlobKey
+			}
+			media = append(media, ApiMediaAttachment{Id: m.Id, Type: m.Type, Description: m.Description, Blurhash: m.Blurhash, Width: m.Width, Height: m.Height, RemoteUrl: m.RemoteUrl, Url: mediaUrl})
+		}
+		tags := tagNames[s.Id]
+		if tags == nil {
+			tags = []string{}
+		}
+		views = append(views, ApiStatus{
+			Id:                 s.Id,
+			Url:                s.Url,
+			CreatedAt:          s.CreatedAt,
+			EditedAt:           timeOrNil(s.EditedAt),
+			DeletedAt:          timeOrNil(s.DeletedAt),
+			Visibility:         s.Visibility,
+			Kind:               s.Kind,
+			Text:               s.Text,
+			Content:            s.Content,
+			SpoilerText:        s.SpoilerText,
+			Sensitive:          s.Sensitive,
+			Language:           s.Language,
+			InReplyToId:        s.InReplyToId,
+			InReplyToAccountId: s.InReplyToAccountId,
+			ReblogOfId:         s.ReblogOfId,
+			ReblogOfUrl:        s.ReblogOfUrl,
+			ReblogAuthorAcct:   s.ReblogAuthorAcct,
+			ReblogAuthorName:   s.ReblogAuthorName,
+			Tags:               tags,
+			MediaAttachments:   media,
+		})
+	}
+	return views, nil
+}
+
+// 同期間隔はスケジュールがなければnull
+func toApiAccount(account Account) ApiAccount {
+	view := ApiAccount{
+		Id:           account.Id,
+		Host:         account.Host,
+		UserName:     account.UserName,
+		AllFetched:   account.AllFetched,
+		Public:       account.Public,
+		ShowUnlisted: account.ShowUnlisted,
+		ShowPrivate:  account.ShowPrivate,
+		ShowDirect:   account.ShowDirect,
+		ShowReblogs:  account.ShowReblogs,
+		ShowDeleted:  account.ShowDeleted,
+	}
+	schedule, err := store.SelectSyncSchedule(account.Id, account.Host)
+	if err == nil {
+		view.SyncIntervalMinutes = &schedule.IntervalMinutes
+	}
+	return view
+}
+
+// 省略された項目は今の値のままにする
+func applyApiAccountUpdate(account Account, update ApiAccountUpdate) error {
+	if update.Public != nil {
+		if err := store.UpdateAccountPublic(account.Id, account.Host, *update.Public); err != nil {
+			return err
+		}
+	}
+	pick := func(v *bool, current bool) bool {
+		if v == nil {
+			return current
+		}
+		return *v
+	}
+	err := store.UpdateAccountVisibility(account.Id, account.Host,
+		pick(update.ShowUnlisted, account.ShowUnlisted),
+		pick(update.ShowPrivate, account.ShowPrivate),
+		pick(update.ShowDirect, account.ShowDirect),
+		pick(update.ShowReblogs, account.ShowReblogs),
+		pick(update.ShowDeleted, account.ShowDeleted))
+	if err != nil {
+		return err
+	}
+	if update.SyncIntervalMinutes != nil {
+		return store.UpdateSyncScheduleInterval(account.Id, account.Host, *update.SyncIntervalMinutes)
+	}
+	return nil
+}
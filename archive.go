@@ -0,0 +1,242 @@
+package activitypublog
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// 1回のUpsertStatusesに渡す件数。SQLiteのプレースホルダーの上限を超えないようにする
+const archiveChunkSize = 200
+
+type ArchiveImportResult struct {
+	Inserted int
+	// すでにAPIから取り込んでいた投稿
+	Skipped int
+	// zipから保存したメディアのファイル
+	Media int
+}
+
+func readZipJSON(r *zip.Reader, name string, v interface{}) error {
+	f, err := r.Open(name)
+	if err != nil {
+		return fmt.Errorf("%s is not in the archive: %v", name, err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	return nil
+}
+
+// アーカイブの持ち主のactor
+func readArchiveActor(r *zip.Reader) (apActor, error) {
+	var actor apActor
+	if err := readZipJSON(r, "actor.json", &actor); err != nil {
+		return actor, err
+	}
+	if actor.Id == "" || actor.PreferredUsername == "" {
+		return actor, fmt.Errorf("actor.json has no id")
+	}
+	return actor, nil
+}
+
+// メディアのパスはmedia_attachments/files/109/876/543/.../original/名前で、数字を続けるとAPIのidになる
+func archiveMediaId(mediaPath string) string {
+	parts := strings.Split(strings.TrimPrefix(mediaPath, "/"), "/")
+	var digits []string
+	for i, part := range parts {
+		if i < 2 {
+			continue
+		}
+		if part == "original" {
+			id := strings.TrimLeft(strings.Join(digits, ""), "0")
+			if id == "" {
+				return ""
+			}
+			return id
+		}
+		digits = append(digits, part)
+	}
+	return ""
+}
+
+// zipの中のメディアをBlobStoreに保存する
+func putArchiveMedia(r *zip.Reader, attachment MediaAttachment, mediaPath string) (MediaAttachment, error) {
+	f, err := r.Open(strings.TrimPrefix(mediaPath, "/"))
+	if err != nil {
+		return attachment, err
+	}
+	defer f.Close()
+	key, err := blobs.Put(f)
+	if err != nil {
+		return attachment, err
+	}
+	attachment.BlobKey = key
+	attachment.ContentType = mime.TypeByExtension(path.Ext(mediaPath))
+	return attachment, nil
+}
+
+// Mastodonの「アーカイブのエクスポート」のzipを取り込む。accountはアーカイブの持ち主でなければならない
+// すでに保存している投稿は上書きしない。APIから取ったもののほうがブーストの本文などを持っているので
+// ただし、保存済みの投稿のメディアがまだダウンロードできていなければzipのファイルで埋める
+func importArchive(ctx context.Context, r *zip.Reader, account Account, host string, token string) (ArchiveImportResult, error) {
+	var result ArchiveImportResult
+	actor, err := readArchiveActor(r)
+	if err != nil {
+		return result, err
+	}
+	if actor.PreferredUsername != account.UserName || hostOf(actor.Id) != host {
+		return result, fmt.Errorf("the archive belongs to %s@%s, not %s@%s", actor.PreferredUsername, hostOf(actor.Id), account.UserName, host)
+	}
+	var outbox apCollection
+	if err := readZipJSON(r, "outbox.json", &outbox); err != nil {
+		return result, err
+	}
+	existing, err := store.SelectStatusIdsByAccount(account.Id, host)
+	if err != nil {
+		return result, err
+	}
+	// 取り込み済みの投稿のメディアのうち、zipのファイルで埋められるもの
+	mediaPaths := map[string]string{}
+	var newStatuses []Status
+	var existingIds []string
+	for _, item := range outbox.activities() {
+		var activity apActivity
+		if !item.isObject() || json.Unmarshal(item, &activity) != nil {
+			continue
+		}
+		s, ok := activity.toStatus(actor)
+		if !ok {
+			continue
+		}
+		// actorのURLではなく、ログインしているアカウントのidで保存する
+		s.AccountId = account.Id
+		if s.InReplyToAccountId == actor.Id {
+			s.InReplyToAccountId = account.Id
+		}
+		for i, m := range s.MediaAttachments {
+			// zipの中のファイルはURLのパスと同じ場所にある
+			u, err := url.Parse(m.RemoteUrl)
+			if err != nil {
+				continue
+			}
+			mediaPath := u.Path
+			if id := archiveMediaId(mediaPath); id != "" {
+				m.Id = id
+			}
+			mediaPaths[m.Id] = mediaPath
+			s.MediaAttachments[i] = m
+		}
+		if _, ok := existing[s.Id]; ok {
+			existingIds = append(existingIds, s.Id)
+			result.Skipped++
+			continue
+		}
+		newStatuses = append(newStatuses, s)
+	}
+	for start := 0; start < len(newStatuses); start += archiveChunkSize {
+		end := start + archiveChunkSize
+		if end > len(newStatuses) {
+			end = len(newStatuses)
+		}
+		chunk := newStatuses[start:end]
+		for i := range chunk {
+			for j, m := range chunk[i].MediaAttachments {
+				m, err := putArchiveMedia(r, m, mediaPaths[m.Id])
+				if err != nil {
+					// zipになければ、あとでメディアの保存処理がURLからダウンロードする
+					continue
+				}
+				chunk[i].MediaAttachments[j] = m
+				result.Media++
+			}
+		}
+		ingested, err := ingestStatuses(ctx, chunk, account.Id, host, token)
+		if err != nil {
+			return result, err
+		}
+		result.Inserted += ingested.Inserted
+	}
+	for start := 0; start < len(existingIds); start += archiveChunkSize {
+		end := start + archiveChunkSize
+		if end > len(existingIds) {
+			end = len(existingIds)
+		}
+		attachments, err := store.SelectMediaAttachmentsByStatuses(host, existingIds[start:end])
+		if err != nil {
+			return result, err
+		}
+		for _, a := range attachments {
+			mediaPath, ok := mediaPaths[a.Id]
+			if a.BlobKey != "" || !ok {
+				continue
+			}
+			a, err := putArchiveMedia(r, a, mediaPath)
+			if err != nil {
+				continue
+			}
+			if err := store.UpdateMediaAttachmentBlob(a); err != nil {
+				return result, err
+			}
+			result.Media++
+		}
+	}
+	return result, nil
+}
+
+// cmd/import-archiveから呼ばれる。argsはzipのパスひとつ
+// アカウントはアーカイブのactorから探すので、先に一度ログインしておくこと
+func ImportArchiveCommand(args []string) error {
+	if err := godotenv.Load(".env"); err != nil {
+		fmt.Println("failed to load env file")
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import-archive archive.zip")
+	}
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	store = s
+	if _, err := store.Migrate(); err != nil {
+		return err
+	}
+	blobs, err = OpenBlobStore()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.OpenReader(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer zr.Close()
+	actor, err := readArchiveActor(&zr.Reader)
+	if err != nil {
+		return err
+	}
+	host := hostOf(actor.Id)
+	account, err := store.SelectAccountByUserName(actor.PreferredUsername, host)
+	if err != nil {
+		return fmt.Errorf("sign in as %s@%s once before importing: %v", actor.PreferredUsername, host, err)
+	}
+	// 編集された投稿の履歴を取るのに使う。なければ公開の投稿の分だけ取れる
+	token := ""
+	if credential, err := store.SelectCredential(account.Id, host); err == nil {
+		token = credential.AccessToken
+	}
+	result, err := importArchive(ctx, &zr.Reader, account, host, token)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %s@%s: %d new statuses, %d already stored, %d media files\n", account.UserName, host, result.Inserted, result.Skipped, result.Media)
+	return nil
+}
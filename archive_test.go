@@ -0,0 +1,87 @@
+package activitypublog
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// actor.json、outbox.jsonと添付ファイルひとつだけのアーカイブ
+func testArchive(t *testing.T, mediaPath string, media []byte) *zip.Reader {
+	t.Helper()
+	files := map[string]string{
+		"actor.json": `{"id": "https://` + testHost + `/users/alice", "type": "Person", "preferredUsername": "alice", "followers": "https://` + testHost + `/users/alice/followers"}`,
+		"outbox.json": `{"type": "OrderedCollection", "orderedItems": [{
+			"id": "https://` + testHost + `/users/alice/statuses/109876543210987654/activity",
+			"type": "Create",
+			"published": "2024-01-02T03:04:05Z",
+			"to": ["https://www.w3.org/ns/activitystreams#Public"],
+			"object": {
+				"id": "https://` + testHost + `/users/alice/statuses/109876543210987654",
+				"type": "Note",
+				"published": "2024-01-02T03:04:05Z",
+				"content": "<p>photo</p>",
+				"to": ["https://www.w3.org/ns/activitystreams#Public"],
+				"attachment": [{"type": "Document", "mediaType": "image/png", "url": "/` + mediaPath + `", "name": "alt"}]
+			}
+		}]}`,
+		mediaPath: string(media),
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		must(t, err)
+		_, err = f.Write([]byte(content))
+		must(t, err)
+	}
+	must(t, w.Close())
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	must(t, err)
+	return r
+}
+
+func TestImportArchive(t *testing.T) {
+	savedStore, savedBlobs := store, blobs
+	t.Cleanup(func() { store, blobs = savedStore, savedBlobs })
+	store = openSQLiteTestStore(t)
+	defer store.Close()
+	_, err := store.Migrate()
+	must(t, err)
+	blobs, err = NewFileBlobStore(t.TempDir())
+	must(t, err)
+	_, err = store.InsertAccountIfNotExists("1", "alice", testHost)
+	must(t, err)
+	account, err := store.SelectAccount("1", testHost)
+	must(t, err)
+
+	media := []byte("\x89PNG image")
+	r := testArchive(t, "media_attachments/files/109/876/543/210/987/654/original/photo.png", media)
+	result, err := importArchive(ctx, r, account, testHost, "")
+	must(t, err)
+	if result.Inserted != 1 || result.Skipped != 0 || result.Media != 1 {
+		t.Errorf("result = %+v", result)
+	}
+
+	attachments, err := store.SelectMediaAttachmentsByStatuses(testHost, []string{"109876543210987654"})
+	must(t, err)
+	if len(attachments) != 1 {
+		t.Fatalf("len(attachments) = %d", len(attachments))
+	}
+	a := attachments[0]
+	if a.Id != "109876543210987654" || a.RemoteUrl != "https://"+testHost+"/media_attachments/files/109/876/543/210/987/654/original/photo.png" || a.Description != "alt" || a.ContentType != "image/png" {
+		t.Errorf("attachment = %+v", a)
+	}
+	if a.BlobKey == "" {
+		t.Fatal("the media in the archive is not stored")
+	}
+	f, err := blobs.Open(a.BlobKey)
+	must(t, err)
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	must(t, err)
+	if !bytes.Equal(got, media) {
+		t.Errorf("blob = %q, want %q", got, media)
+	}
+}
@@ -0,0 +1,174 @@
+package activitypublog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultBackfillWorkers = 2
+
+const backfillPageInterval = time.Second * 2
+
+func BackfillWorkers() int {
+	v, err := strconv.Atoi(os.Getenv("BACKFILL_WORKERS"))
+	if err != nil || v <= 0 {
+		return defaultBackfillWorkers
+	}
+	return v
+}
+
+// アカウントに進行中のジョブがなければ新しくキューに積む
+func EnqueueBackfill(account Account, host string) error {
+	return enqueueJob(account, host, BackfillKindFetch)
+}
+
+func enqueueJob(account Account, host string, kind string) error {
+	latest, ok, err := store.SelectLatestBackfillJob(account.Id, host, kind)
+	if err != nil {
+		return err
+	}
+	if ok && latest.Active() {
+		return nil
+	}
+	now := time.Now().UTC()
+	job := BackfillJob{
+		AccountId:     account.Id,
+		Host:          host,
+		Kind:          kind,
+		State:         BackfillQueued,
+		TotalStatuses: account.StatusesCount,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	return store.InsertBackfillJob(&job)
+}
+
+func (j BackfillJob) Active() bool {
+	return j.State == BackfillQueued || j.State == BackfillRunning || j.State == BackfillPaused
+}
+
+// 1ページあたりの平均所要時間から残りページ数の所要時間を見積もる。見積もれなければ0
+// 削除の検出は保存済みの件数に関係なく全ページをたどるので、調べた件数から残りを出す
+func (j BackfillJob) ETA(storedStatuses int) time.Duration {
+	done := storedStatuses
+	if j.Kind == BackfillKindReconcile {
+		done = int(j.StatusesFetched)
+	}
+	if j.PagesFetched == 0 || j.StartedAt.IsZero() || j.TotalStatuses <= done {
+		return 0
+	}
+	perPage := j.UpdatedAt.Sub(j.StartedAt) / time.Duration(j.PagesFetched)
+	remainingPages := (j.TotalStatuses - done + StatusPageLimit() - 1) / StatusPageLimit()
+	return perPage * time.Duration(remainingPages)
+}
+
+// ジョブの状態がrunningでなくなる（一時停止・キャンセル）か、最古の投稿まで取得し終えるまでページを取得する
+func runBackfillJob(ctx context.Context, job BackfillJob) (string, error) {
+	credential, err := store.SelectCredential(job.AccountId, job.Host)
+	if err != nil {
+		return BackfillFailed, err
+	}
+	adapter, err := serverAdapter(job.Host)
+	if err != nil {
+		return BackfillFailed, err
+	}
+	for {
+		if ctx.Err() != nil {
+			// サーバー停止時はrunningのまま残し、次回起動時に再開する
+			return BackfillRunning, nil
+		}
+		current, err := store.SelectBackfillJob(job.Id)
+		if err != nil {
+			return BackfillFailed, err
+		}
+		if current.State != BackfillRunning {
+			return current.State, nil
+		}
+		// 前のページのrel="next"があればそれを読む。なければ保存済みの最古の投稿より古いページを読む
+		// 終わりは空のページで判断する。nextがなくても、最古の投稿のidで念のためもう1ページ確かめる
+		oldestStatusId := ""
+		if job.NextPageUrl == "" {
+			oldestStatusId, err = store.SelectOldestStatusIdByAccount(job.AccountId)
+			if err != nil {
+				return BackfillFailed, err
+			}
+		}
+		statuses, next, err := adapter.StatusesOlderThan(ctx, job.Host, credential.AccessToken, job.AccountId, oldestStatusId, job.NextPageUrl)
+		if err != nil {
+			return BackfillFailed, err
+		}
+		if len(statuses) == 0 {
+			if err := store.UpdateAccountAllFetched(job.AccountId); err != nil {
+				return BackfillFailed, err
+			}
+			return BackfillDone, nil
+		}
+		result, err := ingestStatuses(ctx, statuses, job.AccountId, job.Host, credential.AccessToken)
+		if err != nil {
+			return BackfillFailed, err
+		}
+		job.PagesFetched++
+		job.StatusesFetched += int64(result.Inserted)
+		job.OldestId = statuses[len(statuses)-1].Id
+		job.NextPageUrl = next
+		job.UpdatedAt = time.Now().UTC()
+		if err := store.UpdateBackfillJobProgress(job); err != nil {
+			return BackfillFailed, err
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backfillPageInterval):
+		}
+	}
+}
+
+func backfillWorker(ctx context.Context, id int, poll time.Duration) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		job, ok, err := store.ClaimBackfillJob()
+		if err != nil {
+			fmt.Printf("backfill worker %d: %v\n", id, err)
+		}
+		if ok {
+			run := runBackfillJob
+			switch job.Kind {
+			case BackfillKindReconcile:
+				run = runReconcileJob
+			case BackfillKindOutbox:
+				run = runOutboxJob
+			}
+			state, err := run(ctx, job)
+			lastError := ""
+			if err != nil {
+				lastError = err.Error()
+				fmt.Printf("backfill worker %d: job %d: %v\n", id, job.Id, err)
+			}
+			if state == BackfillDone || state == BackfillFailed {
+				if err := store.FinishBackfillJob(job.Id, state, lastError); err != nil {
+					fmt.Printf("backfill worker %d: %v\n", id, err)
+				}
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(poll):
+		}
+	}
+}
+
+// n個のワーカーでバックフィルジョブを処理する。前回停止時に実行中だったジョブは再開される
+func StartBackfillWorkers(ctx context.Context, n int) {
+	if err := store.RequeueRunningBackfillJobs(); err != nil {
+		fmt.Printf("backfill: %v\n", err)
+	}
+	for i := 0; i < n; i++ {
+		go backfillWorker(ctx, i, time.Second*5)
+	}
+}
@@ -0,0 +1,90 @@
+package activitypublog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// メディアなどのファイルを中身のSHA-256をキーにして保存する。同じファイルは1つしか保存されない
+type BlobStore interface {
+	Put(r io.Reader) (key string, err error)
+	Open(key string) (io.ReadCloser, error)
+}
+
+var blobs BlobStore
+
+var blobKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// 環境変数の設定に従ってBlobStoreを開く。今はファイルシステムのみ
+func OpenBlobStore() (BlobStore, error) {
+	switch os.Getenv("BLOB_STORE") {
+	case "", "fs":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "blobs"
+		}
+		return NewFileBlobStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE: %s", os.Getenv("BLOB_STORE"))
+	}
+}
+
+type FileBlobStore struct {
+	root string
+}
+
+func NewFileBlobStore(root string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create blob dir: %v", err)
+	}
+	return &FileBlobStore{root: root}, nil
+}
+
+// ab/cd/abcd...のように先頭4文字でディレクトリを分ける
+func (s *FileBlobStore) path(key string) string {
+	return filepath.Join(s.root, key[0:2], key[2:4], key)
+}
+
+func (s *FileBlobStore) Put(r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(s.root, "upload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write blob: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write blob: %v", err)
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+	p := s.path(key)
+	if _, err := os.Stat(p); err == nil {
+		return key, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create blob dir: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return "", fmt.Errorf("failed to store blob: %v", err)
+	}
+	return key, nil
+}
+
+func (s *FileBlobStore) Open(key string) (io.ReadCloser, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return nil, fmt.Errorf("invalid blob key: %s", key)
+	}
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob: %v", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,259 @@
+package activitypublog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// トークンが無効。取り消されたときなどに返るので、ログインし直してもらう
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+)
+
+// 2xx以外のレスポンス。401/403/404はerrors.IsでErrUnauthorizedなどと比べられる
+type APIError struct {
+	StatusCode int
+	Method     string
+	Url        string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s: status %d: %s", e.Method, e.Url, e.StatusCode, e.Body)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// X-RateLimit-*ヘッダーから読んだ残り回数と回復する時刻
+type rateLimit struct {
+	remaining int
+	reset     time.Time
+}
+
+// Mastodon APIを呼ぶクライアント。MisskeyのAPIもこれで呼ぶ
+// レート制限をホストとトークンの組ごとに覚えておき、使い切りそうなら間隔を空ける
+// 429と5xx（GETのみ）は指数バックオフで再試行する
+type MastodonClient struct {
+	http       *http.Client
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+
+	mu     sync.Mutex
+	limits map[string]rateLimit
+}
+
+// 残りがこれを下回ったら、回復までの時間を残り回数で割った間隔で送る
+const rateLimitLowWater = 10
+
+func NewMastodonClient(timeout time.Duration) *MastodonClient {
+	return newMastodonClient(&http.Client{Timeout: timeout})
+}
+
+func newMastodonClient(h *http.Client) *MastodonClient {
+	return &MastodonClient{
+		http:       h,
+		maxRetries: 5,
+		baseDelay:  time.Second,
+		maxDelay:   time.Minute * 5,
+		limits:     map[string]rateLimit{},
+	}
+}
+
+var mastodon = NewMastodonClient(time.Second * 30)
+
+// outboxの取り込みなど、ログインしていないサーバーに取りに行くときのクライアント。内部のアドレスには接続しない
+var remote = newMastodonClient(newRemoteHttpClient(time.Second * 30))
+
+// メディアは大きいことがあるので、APIとは別に長めのタイムアウトにする
+// 添付のURLはリモートのサーバーが決めるので、内部のアドレスには接続しない
+var mediaClient = newRemoteHttpClient(time.Minute * 10)
+
+// ストリーミングは接続したままにするのでタイムアウトを付けない。切断はcontextで行う
+var streamingClient = &http.Client{}
+
+func rateLimitKey(req *http.Request) string {
+	return req.URL.Host + " " + req.Header.Get("Authorization")
+}
+
+// 次のリクエストまでに待つ時間
+func (c *MastodonClient) pace(key string, now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limit, ok := c.limits[key]
+	if !ok || !limit.reset.After(now) || limit.remaining >= rateLimitLowWater {
+		return 0
+	}
+	untilReset := limit.reset.Sub(now)
+	if limit.remaining <= 0 {
+		return untilReset
+	}
+	return untilReset / time.Duration(limit.remaining)
+}
+
+func (c *MastodonClient) observe(key string, header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := time.Parse(time.RFC3339, header.Get("X-RateLimit-Reset"))
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits[key] = rateLimit{remaining: remaining, reset: reset}
+}
+
+// attempt回目の再試行までの時間。Retry-Afterやレート制限の回復時刻があればそれに従い、なければ指数バックオフにゆらぎを足す
+func (c *MastodonClient) backoff(attempt int, resp *http.Response, now time.Time) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if reset, err := time.Parse(time.RFC3339, resp.Header.Get("X-RateLimit-Reset")); err == nil && reset.After(now) {
+				return reset.Sub(now)
+			}
+		}
+	}
+	delay := c.baseDelay << attempt
+	if delay > c.maxDelay || delay <= 0 {
+		delay = c.maxDelay
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// リクエストを送る。2xx以外はレスポンスを閉じて*APIErrorを返す
+// 再試行のときは本文を作り直すので、本文のあるリクエストはhttp.NewRequestWithContextで作ること
+// GET以外は処理されたかもしれないので、429のとき以外は再試行しない
+func (c *MastodonClient) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	key := rateLimitKey(req)
+	idempotent := req.Method == "GET"
+	for attempt := 0; ; attempt++ {
+		if err := sleepContext(ctx, c.pace(key, time.Now())); err != nil {
+			return nil, err
+		}
+		r := req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		resp, err := c.http.Do(r)
+		if err != nil {
+			if ctx.Err() != nil || !idempotent || attempt >= c.maxRetries || errors.Is(err, errNonPublicAddress) {
+				return nil, err
+			}
+			if err := sleepContext(ctx, c.backoff(attempt, nil, time.Now())); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		c.observe(key, resp.Header)
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1000))
+		resp.Body.Close()
+		apiErr := &APIError{StatusCode: resp.StatusCode, Method: req.Method, Url: req.URL.Redacted(), Body: string(body)}
+		retryable := resp.StatusCode == http.StatusTooManyRequests || (idempotent && resp.StatusCode >= 500)
+		if !retryable || attempt >= c.maxRetries {
+			return nil, apiErr
+		}
+		if err := sleepContext(ctx, c.backoff(attempt, resp, time.Now())); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// GETしてJSONをvに読み込む。tokenが空ならAuthorizationヘッダーを付けない
+func (c *MastodonClient) GetJSON(ctx context.Context, u string, token string, v interface{}) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	return c.doJSON(ctx, req, token, v)
+}
+
+// フォームをPOSTしてJSONをvに読み込む
+func (c *MastodonClient) PostFormJSON(ctx context.Context, u string, form url.Values, v interface{}) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.doJSON(ctx, req, "", v)
+}
+
+// JSONをPOSTしてJSONをvに読み込む。MisskeyのAPIはすべてこの形で呼ぶ
+func (c *MastodonClient) PostJSON(ctx context.Context, u string, body interface{}, v interface{}) (http.Header, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request body: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.doJSON(ctx, req, "", v)
+}
+
+func (c *MastodonClient) doJSON(ctx context.Context, req *http.Request, token string, v interface{}) (http.Header, error) {
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	resp, err := c.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, fmt.Errorf("failed to parse response from %s: %v", req.URL.Path, err)
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/chao7150/activitypublog"
+)
+
+func main() {
+	if err := activitypublog.MigrateCommand(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,6 +1,11 @@
 package activitypublog
 
-import "github.com/labstack/echo/v4"
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
 
 // クライアントが非ログインならログインページにリダイレクトする
 // ログイン済みならtokenとhostを返す
@@ -17,3 +22,18 @@ func RequireLoggedIn(c echo.Context) (string, string, error) {
 	host := hostCookie.Value
 	return token, host, nil
 }
+
+func ClearLoginCookies(c echo.Context) {
+	tokenCookie := &http.Cookie{
+		Name:    "token",
+		Value:   "",
+		Expires: time.Unix(0, 0),
+	}
+	c.SetCookie(tokenCookie)
+	hostCookie := &http.Cookie{
+		Name:    "host",
+		Value:   "",
+		Expires: time.Unix(0, 0),
+	}
+	c.SetCookie(hostCookie)
+}
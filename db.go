@@ -1,15 +1,47 @@
 package activitypublog
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
 )
 
-func ConvertCreatedAtToTokyo(statuses []Status) []Status {
+// MySQLとSQLiteの両方をbunで扱う。方言の差はupsertなどのヘルパーに閉じ込める
+type bunStore struct {
+	db *bun.DB
+}
+
+// conflictの列が衝突したらcolumnsを新しい値で上書きするinsertにする
+func (s *bunStore) upsert(q *bun.InsertQuery, conflict []string, columns ...string) *bun.InsertQuery {
+	if s.db.Dialect().Name() == dialect.MySQL {
+		q = q.On("DUPLICATE KEY UPDATE")
+		for _, c := range columns {
+			q = q.Set(c + " = VALUES(" + c + ")")
+		}
+		return q
+	}
+	q = q.On("CONFLICT (" + strings.Join(conflict, ", ") + ") DO UPDATE")
+	for _, c := range columns {
+		q = q.Set(c + " = EXCLUDED." + c)
+	}
+	return q
+}
+
+// 一覧表示に使う列。本文のHTMLなど重いものは含めない
+var statusListColumns = []string{"status.id", "status.host", "status.account_id", "status.text", "status.spoiler_text", "status.sensitive", "status.url", "status.created_at", "status.visibility", "status.edited_at", "status.in_reply_to_id", "status.in_reply_to_account_id", "status.kind", "status.reblog_of_id", "status.reblog_of_url", "status.reblog_author_acct", "status.reblog_author_name", "status.deleted_at"}
+
+func tokyo() *time.Location {
 	location, _ := time.LoadLocation("Asia/Tokyo")
+	return location
+}
+
+func ConvertCreatedAtToTokyo(statuses []Status) []Status {
+	location := tokyo()
 	for i, v := range statuses {
 		statuses[i].CreatedAt = v.CreatedAt.In(location)
 	}
@@ -19,13 +51,14 @@ func ConvertCreatedAtToTokyo(statuses []Status) []Status {
 func ConvertCreatedAtToUTC(statuses []Status) []Status {
 	for i, v := range statuses {
 		statuses[i].CreatedAt = v.CreatedAt.UTC()
+		statuses[i].EditedAt = v.EditedAt.UTC()
 	}
 	return statuses
 }
 
-func dSelectAppByHost(host string) (App, error) {
+func (s *bunStore) SelectAppByHost(host string) (App, error) {
 	var app App
-	err := bundb.NewSelect().Model(&app).Where("host = ?", host).Scan(ctx)
+	err := s.db.NewSelect().Model(&app).Where("host = ?", host).Scan(ctx)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return app, fmt.Errorf("no app for hostname: %s", host)
@@ -35,34 +68,152 @@ func dSelectAppByHost(host string) (App, error) {
 	return app, nil
 }
 
-func dInsertApp(app App) error {
-	_, err := bundb.NewInsert().Model(&app).Exec(ctx)
+func (s *bunStore) InsertApp(app App) error {
+	_, err := s.db.NewInsert().Model(&app).Exec(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create app: %v", err)
 	}
 	return nil
 }
 
-func dInsertStatuses(statuses []Status, accountId string, host string) (int64, error) {
+// ログインのたびにNodeInfoで調べたソフトウェアとバージョンで更新する
+func (s *bunStore) UpdateAppSoftware(host string, software string, version string) error {
+	_, err := s.db.NewUpdate().Model((*App)(nil)).Set("software = ?", software).Set("software_version = ?", version).Where("host = ?", host).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to update app software: %v", err)
+	}
+	return nil
+}
+
+// (id, host)が同じ行があれば変更された列だけ更新する。同じページを何度取り込んでも失敗しない
+// 件数は先に読んだ行と比べて数えるだけで、書き込みはupsertにするので同時に取り込んでも重複キーで失敗しない
+func (s *bunStore) UpsertStatuses(statuses []Status, accountId string, host string) (IngestResult, error) {
+	var result IngestResult
 	if len(statuses) == 0 {
-		return 0, nil
+		return result, nil
 	}
 	statuses = ConvertCreatedAtToUTC(statuses)
-	res, err := bundb.NewInsert().Model(&statuses).Exec(ctx)
+	ids := make([]string, len(statuses))
+	for i, v := range statuses {
+		ids[i] = v.Id
+		if v.Kind == "" {
+			statuses[i].Kind = StatusKindPost
+		}
+	}
+	err := s.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var existing []Status
+		if err := tx.NewSelect().Model(&existing).Where("host = ?", host).Where("id IN (?)", bun.In(ids)).Scan(ctx); err != nil {
+			return fmt.Errorf("failed to select existing statuses: %v", err)
+		}
+		existingById := make(map[string]Status, len(existing))
+		for _, v := range existing {
+			existingById[v.Id] = v
+		}
+		now := time.Now().UTC()
+		var writes []Status
+		// 同じページ内に同じidが重複していたら後のもので1行にまとめる
+		writeIndex := map[string]int{}
+		write := func(v Status) {
+			if i, ok := writeIndex[v.Id]; ok {
+				writes[i] = v
+				return
+			}
+			writeIndex[v.Id] = len(writes)
+			writes = append(writes, v)
+		}
+		var revisions []StatusRevision
+		for _, v := range statuses {
+			old, ok := existingById[v.Id]
+			existingById[v.Id] = v
+			if !ok {
+				write(v)
+				revisions = append(revisions, newStatusRevision(v, now))
+				if !v.EditedAt.IsZero() {
+					result.Edited = append(result.Edited, v.Id)
+				}
+				result.Inserted++
+				continue
+			}
+			if !statusChanged(old, v) {
+				result.Unchanged++
+				continue
+			}
+			write(v)
+			revisions = append(revisions, newStatusRevision(v, now))
+			if !v.EditedAt.IsZero() && editedAtChanged(old, v) {
+				result.Edited = append(result.Edited, v.Id)
+			}
+			result.Updated++
+		}
+		if len(writes) > 0 {
+			if _, err := s.upsert(tx.NewInsert().Model(&writes), []string{"id", "host"}, statusMutableColumns...).Exec(ctx); err != nil {
+				return fmt.Errorf("failed to upsert statuses: %v", err)
+			}
+		}
+		return insertStatusRevisions(ctx, tx, revisions)
+	})
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert statuses: %v", err)
+		return IngestResult{}, err
 	}
-	rowsAffected, err := res.RowsAffected()
+	return result, nil
+}
+
+// 同じ版（投稿と時刻が同じもの）がすでにあれば入れない
+func insertStatusRevisions(ctx context.Context, db bun.IDB, revisions []StatusRevision) error {
+	if len(revisions) == 0 {
+		return nil
+	}
+	if _, err := db.NewInsert().Model(&revisions).Ignore().Exec(ctx); err != nil {
+		return fmt.Errorf("failed to insert status revisions: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) InsertStatusRevisions(revisions []StatusRevision) error {
+	return insertStatusRevisions(ctx, s.db, revisions)
+}
+
+func (s *bunStore) SelectStatusRevisions(id string, host string) ([]StatusRevision, error) {
+	var revisions []StatusRevision
+	err := s.db.NewSelect().Model(&revisions).Where("host = ?", host).Where("status_id = ?", id).Order("revised_at ASC").Scan(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get insert result: %v", err)
+		return nil, fmt.Errorf("SelectStatusRevisions: %v", err)
 	}
-	return rowsAffected, nil
+	return revisions, nil
 }
 
-func execSelectSingleStatusId(query string, accountId string) (string, error) {
+// 削除済みのものも含めて、アカウントの投稿のidと削除済みかどうかを返す
+func (s *bunStore) SelectStatusIdsByAccount(accountId string, host string) (map[string]bool, error) {
+	var statuses []Status
+	err := s.db.NewSelect().Model(&statuses).Column("id", "deleted_at").Where("account_id = ?", accountId).Where("host = ?", host).Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SelectStatusIdsByAccount: %v", err)
+	}
+	deleted := make(map[string]bool, len(statuses))
+	for _, v := range statuses {
+		deleted[v.Id] = !v.DeletedAt.IsZero()
+	}
+	return deleted, nil
+}
+
+// まだ削除済みになっていないものだけdeleted_atを付ける
+func (s *bunStore) MarkStatusesDeleted(accountId string, host string, ids []string, deletedAt time.Time) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := s.db.NewUpdate().Model((*Status)(nil)).Set("deleted_at = ?", deletedAt).
+		Where("account_id = ?", accountId).Where("host = ?", host).Where("id IN (?)", bun.In(ids)).Where("deleted_at IS NULL").Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("MarkStatusesDeleted: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+func (s *bunStore) selectSingleStatusId(accountId string, order string) (string, error) {
 	var id string
-	row := db.QueryRow(query, accountId)
-	if err := row.Scan(&id); err != nil {
+	err := s.db.NewSelect().Model((*Status)(nil)).Column("id").Where("account_id = ?", accountId).Order(order).Limit(1).Scan(ctx, &id)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return "", nil
 		}
@@ -71,39 +222,35 @@ func execSelectSingleStatusId(query string, accountId string) (string, error) {
 	return id, nil
 }
 
-func dSelectNewestStatusIdByAccount(accoutId string) (string, error) {
-	return execSelectSingleStatusId("SELECT id FROM status WHERE account_id = ? ORDER BY id DESC LIMIT 1", accoutId)
+func (s *bunStore) SelectNewestStatusIdByAccount(accoutId string) (string, error) {
+	return s.selectSingleStatusId(accoutId, "id DESC")
 }
 
-func dSelectOldestStatusIdByAccount(accoutId string) (string, error) {
-	return execSelectSingleStatusId("SELECT id FROM status WHERE account_id = ? ORDER BY id ASC LIMIT 1", accoutId)
+func (s *bunStore) SelectOldestStatusIdByAccount(accoutId string) (string, error) {
+	return s.selectSingleStatusId(accoutId, "id ASC")
 }
 
-func dSelectStatusesByAccountAndText(accountId string, includedText string) ([]Status, error) {
-	var res []Status
-
-	rows, err := db.Query("SELECT id, text, url, created_at FROM status WHERE account_id = ? AND text LIKE CONCAT('%', ?, '%') ORDER BY id DESC", accountId, includedText)
+// 検索クエリに合う投稿。関連度順でなければ新しい順
+func (s *bunStore) SelectStatusesByAccountAndText(accountId string, search SearchQuery, filter StatusFilter) ([]Status, error) {
+	var statuses []Status
+	err := s.db.NewSelect().
+		Model(&statuses).
+		Column(statusListColumns...).
+		Where("account_id = ?", accountId).
+		Apply(search.apply).
+		Apply(filter.apply).
+		Apply(search.order).
+		Scan(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("query failed: %v", err)
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var status Status
-		if err := rows.Scan(&status.Id, &status.Text, &status.Url, &status.CreatedAt); err != nil {
-			return nil, fmt.Errorf("scan failed: %v", err)
-		}
-		res = append(res, status)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("rows included error: %v", err)
-	}
-
-	statuses := ConvertCreatedAtToTokyo(res)
-	return statuses, nil
+	return ConvertCreatedAtToTokyo(statuses), nil
 }
 
-func dInsertAccountIfNotExists(id string, username string, host string) (int64, error) {
-	res, err := db.Exec("INSERT INTO account SELECT * FROM (SELECT ? as c1, ? as c2, ? as c3, ? as c4, ? as c5, ? as c6, ? as c7, false) AS tmp WHERE NOT EXISTS (SELECT id FROM account WHERE id = ?) LIMIT 1", id, host, username, false, false, false, false, id)
+func (s *bunStore) InsertAccountIfNotExists(id string, username string, host string) (int64, error) {
+	account := Account{Id: id, Host: host, UserName: username}
+	// AllFetchedはdefault:trueなので明示しないとtrueで作られてしまう
+	res, err := s.db.NewInsert().Model(&account).Value("all_fetched", "?", false).Ignore().Exec(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("failed to insert account: %v", err)
 	}
@@ -114,87 +261,80 @@ func dInsertAccountIfNotExists(id string, username string, host string) (int64,
 	return rowsAffected, nil
 }
 
-func dSelectAccountAllFetchedById(accountId string, host string) (bool, error) {
+func (s *bunStore) SelectAccountAllFetchedById(accountId string, host string) (bool, error) {
 	var account Account
-	err := bundb.NewSelect().Model(&account).Column("all_fetched").Where("id = ? AND host = ?", accountId, host).Scan(ctx)
+	err := s.db.NewSelect().Model(&account).Column("all_fetched").Where("id = ? AND host = ?", accountId, host).Scan(ctx)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
 		}
-		return false, fmt.Errorf("dSelectAccountAllFetchedById: %v", err)
+		return false, fmt.Errorf("SelectAccountAllFetchedById: %v", err)
 	}
 	return account.AllFetched, nil
 }
 
-func dUpdateAccountAllFetched(accountId string) error {
-	_, err := bundb.NewUpdate().Model(&Account{AllFetched: true}).Column("all_fetched").Where("id = ?", accountId).Exec(ctx)
+func (s *bunStore) UpdateAccountAllFetched(accountId string) error {
+	_, err := s.db.NewUpdate().Model(&Account{AllFetched: true}).Column("all_fetched").Where("id = ?", accountId).Exec(ctx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func dUpdateAccountPublic(accountId string, host string, public bool) error {
-	_, err := bundb.NewUpdate().Model(&Account{Public: public}).Column("public").Where("id = ?", accountId).Where("host = ?", host).Exec(ctx)
+func (s *bunStore) UpdateAccountPublic(accountId string, host string, public bool) error {
+	_, err := s.db.NewUpdate().Model(&Account{Public: public}).Column("public").Where("id = ?", accountId).Where("host = ?", host).Exec(ctx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func dSelectAccount(accountId string, host string) (Account, error) {
+func (s *bunStore) SelectAccount(accountId string, host string) (Account, error) {
 	var account Account
-	err := bundb.NewSelect().Model(&account).Where("id = ? AND host = ?", accountId, host).Scan(ctx)
+	err := s.db.NewSelect().Model(&account).Where("id = ? AND host = ?", accountId, host).Scan(ctx)
 	if err != nil {
-		return account, fmt.Errorf("dSelectAccount: %v", err)
+		return account, fmt.Errorf("SelectAccount: %v", err)
 	}
 	return account, nil
 }
 
-func dSelectAccountByUserName(username string, host string) (Account, error) {
+func (s *bunStore) SelectAccountByUserName(username string, host string) (Account, error) {
 	var account Account
-	err := bundb.NewSelect().Model(&account).Where("user_name = ? AND host = ?", username, host).Scan(ctx)
+	err := s.db.NewSelect().Model(&account).Where("user_name = ? AND host = ?", username, host).Scan(ctx)
 	if err != nil {
-		return account, fmt.Errorf("dSelectAccountByUserName: %v", err)
+		return account, fmt.Errorf("SelectAccountByUserName: %v", err)
 	}
 	return account, nil
 }
 
-func dUpdateAccountVisibility(accountId string, host string, showUnlisted bool, showPrivate bool, showDirect bool) error {
-	_, err := bundb.NewUpdate().Model(&Account{ShowUnlisted: showUnlisted, ShowPrivate: showPrivate, ShowDirect: showDirect}).Column("show_unlisted", "show_private", "show_direct").Where("id = ?", accountId).Where("host = ?", host).Exec(ctx)
+func (s *bunStore) UpdateAccountVisibility(accountId string, host string, showUnlisted bool, showPrivate bool, showDirect bool, showReblogs bool, showDeleted bool) error {
+	_, err := s.db.NewUpdate().Model(&Account{ShowUnlisted: showUnlisted, ShowPrivate: showPrivate, ShowDirect: showDirect, ShowReblogs: showReblogs, ShowDeleted: showDeleted}).Column("show_unlisted", "show_private", "show_direct", "show_reblogs", "show_deleted").Where("id = ?", accountId).Where("host = ?", host).Exec(ctx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func dSelectStatusesByAccountWithRestriction(username string, host string) ([]Status, error) {
+func (s *bunStore) SelectStatusesByAccountWithRestriction(username string, host string, filter StatusFilter) ([]Status, error) {
 	var account Account
-	err := bundb.NewSelect().Model(&account).Column("show_unlisted", "show_private", "show_direct").Where("user_name = ? AND host = ?", username, host).Scan(ctx)
+	err := s.db.NewSelect().Model(&account).Column("show_unlisted", "show_private", "show_direct", "show_reblogs", "show_deleted").Where("user_name = ? AND host = ?", username, host).Scan(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("visibitily query failed: %v", err)
 	}
 
-	var visibilities []string = []string{"public"}
-	if account.ShowUnlisted {
-		visibilities = append(visibilities, "unlisted")
-	}
-	if account.ShowPrivate {
-		visibilities = append(visibilities, "private")
-	}
-	if account.ShowDirect {
-		visibilities = append(visibilities, "direct")
-	}
+	visibilities := account.PublicVisibilities()
+	filter = account.PublicFilter(filter)
 
 	var statuses []Status
 
-	err = bundb.NewSelect().
+	err = s.db.NewSelect().
 		Model(&statuses).
-		Column("status.text", "status.created_at").
+		Column(statusListColumns...).
 		Join("INNER JOIN account").
 		JoinOn("status.account_id = account.id").
 		Where("account.user_name = ? AND account.host = ?", username, host).
 		Where("visibility in (?)", bun.In(visibilities)).
+		Apply(filter.apply).
 		Order("status.id DESC").
 		Scan(ctx)
 	if err != nil {
@@ -202,3 +342,585 @@ func dSelectStatusesByAccountWithRestriction(username string, host string) ([]St
 	}
 	return ConvertCreatedAtToTokyo(statuses), nil
 }
+
+func (s *bunStore) UpsertCredential(accountId string, host string, token string) error {
+	credential := Credential{AccountId: accountId, Host: host, AccessToken: token, UpdatedAt: time.Now().UTC()}
+	_, err := s.upsert(s.db.NewInsert().Model(&credential), []string{"account_id", "host"}, "access_token", "updated_at").Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("UpsertCredential: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) SelectCredential(accountId string, host string) (Credential, error) {
+	var credential Credential
+	err := s.db.NewSelect().Model(&credential).Where("account_id = ? AND host = ?", accountId, host).Scan(ctx)
+	if err != nil {
+		return credential, fmt.Errorf("SelectCredential: %v", err)
+	}
+	return credential, nil
+}
+
+func (s *bunStore) SelectCredentials() ([]Credential, error) {
+	var credentials []Credential
+	err := s.db.NewSelect().Model(&credentials).Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SelectCredentials: %v", err)
+	}
+	return credentials, nil
+}
+
+func (s *bunStore) InsertSyncScheduleIfNotExists(accountId string, host string, intervalMinutes int) error {
+	schedule := SyncSchedule{AccountId: accountId, Host: host, IntervalMinutes: intervalMinutes, NextRunAt: time.Now().UTC()}
+	_, err := s.db.NewInsert().Model(&schedule).Ignore().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("InsertSyncScheduleIfNotExists: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) SelectSyncSchedule(accountId string, host string) (SyncSchedule, error) {
+	var schedule SyncSchedule
+	err := s.db.NewSelect().Model(&schedule).Where("account_id = ? AND host = ?", accountId, host).Scan(ctx)
+	if err != nil {
+		return schedule, fmt.Errorf("SelectSyncSchedule: %v", err)
+	}
+	return schedule, nil
+}
+
+func (s *bunStore) SelectDueSyncSchedules(now time.Time) ([]SyncSchedule, error) {
+	var schedules []SyncSchedule
+	err := s.db.NewSelect().Model(&schedules).Where("next_run_at <= ?", now.UTC()).Order("next_run_at ASC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SelectDueSyncSchedules: %v", err)
+	}
+	return schedules, nil
+}
+
+func (s *bunStore) UpdateSyncScheduleResult(schedule SyncSchedule) error {
+	_, err := s.db.NewUpdate().Model(&schedule).Column("next_run_at", "last_run_at", "last_error", "last_fetched").WherePK().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("UpdateSyncScheduleResult: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) UpdateSyncScheduleInterval(accountId string, host string, intervalMinutes int) error {
+	_, err := s.db.NewUpdate().Model(&SyncSchedule{IntervalMinutes: intervalMinutes}).Column("interval_minutes").Where("account_id = ?", accountId).Where("host = ?", host).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("UpdateSyncScheduleInterval: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) CountStatusesByAccount(accountId string, host string) (int, error) {
+	count, err := s.db.NewSelect().Model((*Status)(nil)).Where("account_id = ? AND host = ?", accountId, host).Count(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("CountStatusesByAccount: %v", err)
+	}
+	return count, nil
+}
+
+// 投稿の作成・編集・削除の確認のうち一番新しい時刻。投稿がなければゼロ値
+func (s *bunStore) SelectStatusesLastModified(accountId string, host string) (time.Time, error) {
+	var lastModified time.Time
+	for _, column := range []string{"created_at", "edited_at", "deleted_at"} {
+		var status Status
+		err := s.db.NewSelect().
+			Model(&status).
+			Column(column).
+			Where("account_id = ? AND host = ?", accountId, host).
+			Where("? IS NOT NULL", bun.Ident(column)).
+			OrderExpr("? DESC", bun.Ident(column)).
+			Limit(1).
+			Scan(ctx)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return lastModified, fmt.Errorf("SelectStatusesLastModified: %v", err)
+		}
+		for _, t := range []time.Time{status.CreatedAt, status.EditedAt, status.DeletedAt} {
+			if t.After(lastModified) {
+				lastModified = t
+			}
+		}
+	}
+	return lastModified, nil
+}
+
+func (s *bunStore) InsertBackfillJob(job *BackfillJob) error {
+	_, err := s.db.NewInsert().Model(job).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("InsertBackfillJob: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) SelectBackfillJob(id int64) (BackfillJob, error) {
+	var job BackfillJob
+	err := s.db.NewSelect().Model(&job).Where("id = ?", id).Scan(ctx)
+	if err != nil {
+		return job, fmt.Errorf("SelectBackfillJob: %v", err)
+	}
+	return job, nil
+}
+
+// アカウントの直近のkindのジョブを返す。ジョブが一度もなければokはfalse
+func (s *bunStore) SelectLatestBackfillJob(accountId string, host string, kind string) (BackfillJob, bool, error) {
+	var job BackfillJob
+	err := s.db.NewSelect().Model(&job).Where("account_id = ? AND host = ?", accountId, host).Where("kind = ?", kind).Order("id DESC").Limit(1).Scan(ctx)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return job, false, nil
+		}
+		return job, false, fmt.Errorf("SelectLatestBackfillJob: %v", err)
+	}
+	return job, true, nil
+}
+
+// queuedのジョブを1つrunningにして返す。取れるジョブがなければokはfalse
+func (s *bunStore) ClaimBackfillJob() (BackfillJob, bool, error) {
+	var job BackfillJob
+	for {
+		err := s.db.NewSelect().Model(&job).Where("state = ?", BackfillQueued).Order("id ASC").Limit(1).Scan(ctx)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return job, false, nil
+			}
+			return job, false, fmt.Errorf("ClaimBackfillJob: %v", err)
+		}
+		now := time.Now().UTC()
+		res, err := s.db.NewUpdate().Model((*BackfillJob)(nil)).Set("state = ?", BackfillRunning).Set("started_at = COALESCE(started_at, ?)", now).Set("updated_at = ?", now).Where("id = ? AND state = ?", job.Id, BackfillQueued).Exec(ctx)
+		if err != nil {
+			return job, false, fmt.Errorf("ClaimBackfillJob: %v", err)
+		}
+		// 他のワーカーに先に取られていたら次のジョブを探す
+		if n, _ := res.RowsAffected(); n == 1 {
+			job, err = s.SelectBackfillJob(job.Id)
+			if err != nil {
+				return job, false, err
+			}
+			return job, true, nil
+		}
+	}
+}
+
+func (s *bunStore) UpdateBackfillJobProgress(job BackfillJob) error {
+	_, err := s.db.NewUpdate().Model(&job).Column("pages_fetched", "statuses_fetched", "total_statuses", "oldest_id", "statuses_deleted", "next_page_url", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("UpdateBackfillJobProgress: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) FinishBackfillJob(id int64, state string, lastError string) error {
+	now := time.Now().UTC()
+	_, err := s.db.NewUpdate().Model((*BackfillJob)(nil)).Set("state = ?", state).Set("last_error = ?", lastError).Set("updated_at = ?", now).Set("finished_at = ?", now).Where("id = ? AND state = ?", id, BackfillRunning).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("FinishBackfillJob: %v", err)
+	}
+	return nil
+}
+
+// fromのいずれかの状態にあるジョブだけをtoに変える
+func (s *bunStore) TransitionBackfillJob(id int64, accountId string, host string, to string, from ...string) error {
+	_, err := s.db.NewUpdate().Model((*BackfillJob)(nil)).Set("state = ?", to).Set("updated_at = ?", time.Now().UTC()).Where("id = ? AND account_id = ? AND host = ?", id, accountId, host).Where("state IN (?)", bun.In(from)).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("TransitionBackfillJob: %v", err)
+	}
+	return nil
+}
+
+// 前回の停止時に実行中だったジョブを再開できるようにqueuedに戻す
+func (s *bunStore) RequeueRunningBackfillJobs() error {
+	_, err := s.db.NewUpdate().Model((*BackfillJob)(nil)).Set("state = ?", BackfillQueued).Where("state = ?", BackfillRunning).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("RequeueRunningBackfillJobs: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) InsertPersonalAccessToken(token *PersonalAccessToken) error {
+	_, err := s.db.NewInsert().Model(token).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("InsertPersonalAccessToken: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) SelectPersonalAccessTokens(accountId string, host string) ([]PersonalAccessToken, error) {
+	var tokens []PersonalAccessToken
+	err := s.db.NewSelect().Model(&tokens).Where("account_id = ? AND host = ?", accountId, host).Order("id DESC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SelectPersonalAccessTokens: %v", err)
+	}
+	return tokens, nil
+}
+
+// トークンが見つからなければokはfalse
+func (s *bunStore) SelectPersonalAccessTokenByHash(hash string) (PersonalAccessToken, bool, error) {
+	var token PersonalAccessToken
+	err := s.db.NewSelect().Model(&token).Where("token_hash = ?", hash).Scan(ctx)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return token, false, nil
+		}
+		return token, false, fmt.Errorf("SelectPersonalAccessTokenByHash: %v", err)
+	}
+	return token, true, nil
+}
+
+func (s *bunStore) UpdatePersonalAccessTokenLastUsed(id int64, usedAt time.Time) error {
+	_, err := s.db.NewUpdate().Model((*PersonalAccessToken)(nil)).Set("last_used_at = ?", usedAt.UTC()).Where("id = ?", id).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("UpdatePersonalAccessTokenLastUsed: %v", err)
+	}
+	return nil
+}
+
+// 他のアカウントのトークンは消せない
+func (s *bunStore) DeletePersonalAccessToken(id int64, accountId string, host string) error {
+	_, err := s.db.NewDelete().Model((*PersonalAccessToken)(nil)).Where("id = ? AND account_id = ? AND host = ?", id, accountId, host).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("DeletePersonalAccessToken: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) SelectInstanceActor() (InstanceActor, bool, error) {
+	var actor InstanceActor
+	err := s.db.NewSelect().Model(&actor).Where("id = ?", instanceActorId).Scan(ctx)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return actor, false, nil
+		}
+		return actor, false, fmt.Errorf("SelectInstanceActor: %v", err)
+	}
+	return actor, true, nil
+}
+
+// 複数のプロセスが同時に作っても、先に入れた鍵が使われる
+func (s *bunStore) InsertInstanceActorIfNotExists(actor InstanceActor) error {
+	_, err := s.db.NewInsert().Model(&actor).Ignore().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("InsertInstanceActorIfNotExists: %v", err)
+	}
+	return nil
+}
+
+// 同じ投稿をあとから取り直したら内容を上書きする
+func (s *bunStore) UpsertRemoteStatuses(statuses []RemoteStatus) error {
+	if len(statuses) == 0 {
+		return nil
+	}
+	for i, v := range statuses {
+		statuses[i].CreatedAt = v.CreatedAt.UTC()
+		statuses[i].EditedAt = v.EditedAt.UTC()
+	}
+	_, err := s.upsert(s.db.NewInsert().Model(&statuses), []string{"id", "host"}, "author_acct", "author_name", "author_url", "text", "content", "spoiler_text", "sensitive", "language", "url", "visibility", "edited_at").Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("UpsertRemoteStatuses: %v", err)
+	}
+	return nil
+}
+
+// すでに保存済みのものは入れない
+func (s *bunStore) InsertSavedStatuses(saved []SavedStatus) error {
+	if len(saved) == 0 {
+		return nil
+	}
+	_, err := s.db.NewInsert().Model(&saved).Ignore().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("InsertSavedStatuses: %v", err)
+	}
+	return nil
+}
+
+// statusIdsのうちすでに保存済みのもの
+func (s *bunStore) SelectSavedStatusIds(accountId string, host string, kind string, statusIds []string) (map[string]bool, error) {
+	saved := map[string]bool{}
+	if len(statusIds) == 0 {
+		return saved, nil
+	}
+	var ids []string
+	err := s.db.NewSelect().Model((*SavedStatus)(nil)).Column("status_id").
+		Where("account_id = ? AND host = ? AND kind = ?", accountId, host, kind).Where("status_id IN (?)", bun.In(statusIds)).Scan(ctx, &ids)
+	if err != nil {
+		return nil, fmt.Errorf("SelectSavedStatusIds: %v", err)
+	}
+	for _, id := range ids {
+		saved[id] = true
+	}
+	return saved, nil
+}
+
+// 保存した新しい順に返す。本文・CW・投稿者で絞り込む
+func (s *bunStore) SelectSavedStatuses(accountId string, host string, kind string, includedText string) ([]RemoteStatus, error) {
+	var statuses []RemoteStatus
+	err := s.db.NewSelect().
+		Model(&statuses).
+		ExcludeColumn("content").
+		Join("JOIN saved_status AS saved ON saved.status_id = remote_status.id AND saved.host = remote_status.host").
+		Where("saved.account_id = ? AND saved.host = ? AND saved.kind = ?", accountId, host, kind).
+		WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where("remote_status.text LIKE ?", "%"+includedText+"%").
+				WhereOr("remote_status.spoiler_text LIKE ?", "%"+includedText+"%").
+				WhereOr("remote_status.author_acct LIKE ?", "%"+includedText+"%")
+		}).
+		Order("saved.id DESC").
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SelectSavedStatuses: %v", err)
+	}
+	location := tokyo()
+	for i, v := range statuses {
+		statuses[i].CreatedAt = v.CreatedAt.In(location)
+	}
+	return statuses, nil
+}
+
+func (s *bunStore) Close() error {
+	return s.db.Close()
+}
+
+// メタデータだけを保存・更新する。ダウンロード済みのblob_keyは上書きしない
+func (s *bunStore) UpsertMediaAttachments(attachments []MediaAttachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	_, err := s.upsert(s.db.NewInsert().Model(&attachments), []string{"id", "host"}, "status_id", "position", "type", "description", "blurhash", "remote_url", "preview_url", "width", "height").Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("UpsertMediaAttachments: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) SelectPendingMediaAttachments(limit int, maxAttempts int) ([]MediaAttachment, error) {
+	var attachments []MediaAttachment
+	err := s.db.NewSelect().Model(&attachments).Where("blob_key = ''").Where("download_attempts < ?", maxAttempts).Order("download_attempts ASC").Limit(limit).Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SelectPendingMediaAttachments: %v", err)
+	}
+	return attachments, nil
+}
+
+func (s *bunStore) UpdateMediaAttachmentBlob(attachment MediaAttachment) error {
+	_, err := s.db.NewUpdate().Model(&attachment).Column("blob_key", "content_type", "download_attempts").WherePK().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("UpdateMediaAttachmentBlob: %v", err)
+	}
+	return nil
+}
+
+func (s *bunStore) SelectMediaAttachmentsByStatuses(host string, statusIds []string) ([]MediaAttachment, error) {
+	var attachments []MediaAttachment
+	if len(statusIds) == 0 {
+		return attachments, nil
+	}
+	err := s.db.NewSelect().Model(&attachments).Where("host = ?", host).Where("status_id IN (?)", bun.In(statusIds)).Order("status_id", "position").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SelectMediaAttachmentsByStatuses: %v", err)
+	}
+	return attachments, nil
+}
+
+// 同じファイルは同じキーになるので、複数の投稿の添付が1つのキーを共有することがある
+func (s *bunStore) SelectMediaAttachmentsByBlobKey(key string) ([]MediaAttachment, error) {
+	var attachments []MediaAttachment
+	err := s.db.NewSelect().Model(&attachments).Where("blob_key = ?", key).Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SelectMediaAttachmentsByBlobKey: %v", err)
+	}
+	return attachments, nil
+}
+
+// tagsByStatusはstatus id -> タグ名。渡した投稿のタグはすべて置き換える
+func replaceStatusTags(ctx context.Context, db bun.IDB, host string, tagsByStatus map[string][]string) error {
+	if len(tagsByStatus) == 0 {
+		return nil
+	}
+	var statusIds []string
+	var names []string
+	for statusId, tags := range tagsByStatus {
+		statusIds = append(statusIds, statusId)
+		names = append(names, tags...)
+	}
+	if _, err := db.NewDelete().Model((*StatusTag)(nil)).Where("host = ?", host).Where("status_id IN (?)", bun.In(statusIds)).Exec(ctx); err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	newTags := make([]Tag, len(names))
+	for i, name := range names {
+		newTags[i] = Tag{Name: name}
+	}
+	if _, err := db.NewInsert().Model(&newTags).Ignore().Exec(ctx); err != nil {
+		return err
+	}
+	var tags []Tag
+	if err := db.NewSelect().Model(&tags).Where("name IN (?)", bun.In(names)).Scan(ctx); err != nil {
+		return err
+	}
+	tagIds := make(map[string]int64, len(tags))
+	for _, t := range tags {
+		tagIds[t.Name] = t.Id
+	}
+	var statusTags []StatusTag
+	for statusId, names := range tagsByStatus {
+		for _, name := range names {
+			statusTags = append(statusTags, StatusTag{StatusId: statusId, Host: host, TagId: tagIds[name]})
+		}
+	}
+	if len(statusTags) == 0 {
+		return nil
+	}
+	_, err := db.NewInsert().Model(&statusTags).Ignore().Exec(ctx)
+	return err
+}
+
+func (s *bunStore) ReplaceStatusTags(host string, tagsByStatus map[string][]string) error {
+	err := s.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		return replaceStatusTags(ctx, tx, host, tagsByStatus)
+	})
+	if err != nil {
+		return fmt.Errorf("ReplaceStatusTags: %v", err)
+	}
+	return nil
+}
+
+// visibilitiesがnilならすべての公開範囲を数える
+func (s *bunStore) SelectTagCountsByAccount(accountId string, host string, visibilities []string, filter StatusFilter) ([]TagCount, error) {
+	var counts []TagCount
+	q := s.db.NewSelect().
+		TableExpr("status_tag").
+		ColumnExpr("tag.name AS name, COUNT(*) AS count").
+		Join("INNER JOIN tag ON tag.id = status_tag.tag_id").
+		Join("INNER JOIN status ON status.id = status_tag.status_id AND status.host = status_tag.host").
+		Where("status.account_id = ? AND status.host = ?", accountId, host).
+		Apply(filter.apply).
+		GroupExpr("tag.name").
+		OrderExpr("count DESC, name ASC")
+	if visibilities != nil {
+		q = q.Where("status.visibility IN (?)", bun.In(visibilities))
+	}
+	if err := q.Scan(ctx, &counts); err != nil {
+		return nil, fmt.Errorf("SelectTagCountsByAccount: %v", err)
+	}
+	return counts, nil
+}
+
+func (s *bunStore) SelectStatusesByAccountAndTag(accountId string, host string, tag string, visibilities []string, filter StatusFilter) ([]Status, error) {
+	var statuses []Status
+	q := s.db.NewSelect().
+		Model(&statuses).
+		Column(statusListColumns...).
+		Join("INNER JOIN status_tag ON status_tag.status_id = status.id AND status_tag.host = status.host").
+		Join("INNER JOIN tag ON tag.id = status_tag.tag_id").
+		Where("status.account_id = ? AND status.host = ?", accountId, host).
+		Where("tag.name = ?", normalizeTagName(tag)).
+		Apply(filter.apply).
+		Order("status.id DESC")
+	if visibilities != nil {
+		q = q.Where("status.visibility IN (?)", bun.In(visibilities))
+	}
+	if err := q.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("SelectStatusesByAccountAndTag: %v", err)
+	}
+	return ConvertCreatedAtToTokyo(statuses), nil
+}
+
+// statusIdごとのタグ名
+func (s *bunStore) SelectTagNamesByStatuses(host string, statusIds []string) (map[string][]string, error) {
+	names := map[string][]string{}
+	if len(statusIds) == 0 {
+		return names, nil
+	}
+	var rows []struct {
+		StatusId string
+		Name     string
+	}
+	err := s.db.NewSelect().
+		TableExpr("status_tag").
+		ColumnExpr("status_tag.status_id AS status_id, tag.name AS name").
+		Join("INNER JOIN tag ON tag.id = status_tag.tag_id").
+		Where("status_tag.host = ?", host).
+		Where("status_tag.status_id IN (?)", bun.In(statusIds)).
+		OrderExpr("tag.name ASC").
+		Scan(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("SelectTagNamesByStatuses: %v", err)
+	}
+	for _, r := range rows {
+		names[r.StatusId] = append(names[r.StatusId], r.Name)
+	}
+	return names, nil
+}
+
+// エクスポート用に、削除されたものも含めてすべての列を読む
+func (s *bunStore) SelectAllStatusesByAccount(accountId string, host string) ([]Status, error) {
+	var statuses []Status
+	err := s.db.NewSelect().Model(&statuses).Where("account_id = ? AND host = ?", accountId, host).Order("id DESC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SelectAllStatusesByAccount: %v", err)
+	}
+	return ConvertCreatedAtToTokyo(statuses), nil
+}
+
+// 新しい順ならmaxIdより古い投稿をlimit件。maxIdが空なら最新から
+// 関連度順ではidで区切れないので、offset件飛ばしてlimit件
+func (s *bunStore) SelectStatusesPage(accountId string, host string, search SearchQuery, filter StatusFilter, maxId string, offset int, limit int) ([]Status, error) {
+	var statuses []Status
+	q := s.db.NewSelect().
+		Model(&statuses).
+		Where("account_id = ? AND host = ?", accountId, host).
+		Apply(search.apply).
+		Apply(filter.apply).
+		Apply(search.order).
+		Offset(offset).
+		Limit(limit)
+	if maxId != "" {
+		q = q.Where("id < ?", maxId)
+	}
+	if err := q.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("SelectStatusesPage: %v", err)
+	}
+	return ConvertCreatedAtToTokyo(statuses), nil
+}
+
+// 投稿が保存されていなければokはfalse
+func (s *bunStore) SelectStatus(id string, host string) (Status, bool, error) {
+	var status Status
+	err := s.db.NewSelect().Model(&status).Where("id = ? AND host = ?", id, host).Scan(ctx)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return status, false, nil
+		}
+		return status, false, fmt.Errorf("SelectStatus: %v", err)
+	}
+	status.CreatedAt = status.CreatedAt.In(tokyo())
+	return status, true, nil
+}
+
+// parentIdsへのaccountId自身による返信。visibilitiesがnilならすべての公開範囲
+func (s *bunStore) SelectSelfReplies(accountId string, host string, parentIds []string, visibilities []string, filter StatusFilter) ([]Status, error) {
+	var statuses []Status
+	if len(parentIds) == 0 {
+		return statuses, nil
+	}
+	q := s.db.NewSelect().
+		Model(&statuses).
+		Column(statusListColumns...).
+		Where("status.account_id = ? AND status.host = ?", accountId, host).
+		Where("status.in_reply_to_id IN (?)", bun.In(parentIds)).
+		Apply(filter.apply).
+		Order("status.id ASC")
+	if visibilities != nil {
+		q = q.Where("status.visibility IN (?)", bun.In(visibilities))
+	}
+	if err := q.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("SelectSelfReplies: %v", err)
+	}
+	return ConvertCreatedAtToTokyo(statuses), nil
+}
@@ -1,6 +1,7 @@
 package activitypublog
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -9,6 +10,12 @@ import (
 
 func HandlerError(method string, path string, c echo.Context) func(error) error {
 	return func(err error) error {
+		// トークンが取り消されていたらログインし直してもらう
+		if errors.Is(err, ErrUnauthorized) {
+			fmt.Printf("error %s %s: %v\n", method, path, err)
+			ClearLoginCookies(c)
+			return c.Redirect(302, "/login")
+		}
 		errString := fmt.Sprintf("error %s %s: %v", method, path, err)
 		fmt.Println(errString)
 		return c.String(http.StatusInternalServerError, errString)
@@ -0,0 +1,280 @@
+package activitypublog
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Mastodonのアーカイブと同じ形のactorのURL。outboxから取り込んだアカウントはidがactorのURLになっている
+func exportActorId(account Account, host string) string {
+	if strings.HasPrefix(account.Id, "https://") {
+		return account.Id
+	}
+	return "https://" + host + "/users/" + account.UserName
+}
+
+// Mastodonはメディアのidを9桁以上に0埋めして3桁ずつのディレクトリにする
+// 数字でないidはそのまま1つのディレクトリにする
+func exportMediaPath(a MediaAttachment) string {
+	dir := a.Id
+	if strings.Trim(a.Id, "0123456789") == "" {
+		id := a.Id
+		for len(id) < 9 || len(id)%3 != 0 {
+			id = "0" + id
+		}
+		var parts []string
+		for i := 0; i < len(id); i += 3 {
+			parts = append(parts, id[i:i+3])
+		}
+		dir = strings.Join(parts, "/")
+	}
+	ext := ""
+	if exts, err := mime.ExtensionsByType(a.ContentType); err == nil && len(exts) > 0 {
+		ext = exts[0]
+	}
+	return "media_attachments/files/" + dir + "/original/" + a.BlobKey + ext
+}
+
+// 公開範囲を宛先にする。ダイレクトの宛先は保存していないので空になる
+func exportAudience(visibility string, followers string) ([]string, []string) {
+	switch visibility {
+	case "public":
+		return []string{activityStreamsPublic}, []string{followers}
+	case "unlisted":
+		return []string{followers}, []string{activityStreamsPublic}
+	case "private":
+		return []string{followers}, []string{}
+	}
+	return []string{}, []string{}
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// 保存したメディアのファイルをzipに入れ、アーカイブ内のパスを返す。ファイルがなければ元のURLを返す
+func writeExportMedia(zw *zip.Writer, a MediaAttachment) (string, error) {
+	if a.BlobKey == "" {
+		return a.RemoteUrl, nil
+	}
+	r, err := blobs.Open(a.BlobKey)
+	if err != nil {
+		return a.RemoteUrl, nil
+	}
+	defer r.Close()
+	name := exportMediaPath(a)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return "/" + name, nil
+}
+
+// 保存しているアカウントの投稿を、Mastodonのアーカイブと同じ形のzipにしてwに書き出す
+// outbox.jsonはCreateとAnnounceのOrderedCollection、メディアはmedia_attachments/に入る
+// accountのDisplayNameやAvatarはDBにないので、分かっていれば呼び出し側で入れておく
+func exportArchive(w io.Writer, account Account, host string) error {
+	statuses, err := store.SelectAllStatusesByAccount(account.Id, host)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(w)
+	actorId := exportActorId(account, host)
+	followers := actorId + "/followers"
+	items := make([]map[string]interface{}, 0, len(statuses))
+	for start := 0; start < len(statuses); start += archiveChunkSize {
+		end := start + archiveChunkSize
+		if end > len(statuses) {
+			end = len(statuses)
+		}
+		chunk, err := attachMedia(statuses[start:end])
+		if err != nil {
+			return err
+		}
+		ids := make([]string, 0, len(chunk))
+		for _, s := range chunk {
+			ids = append(ids, s.Id)
+		}
+		tagNames, err := store.SelectTagNamesByStatuses(host, ids)
+		if err != nil {
+			return err
+		}
+		for _, s := range chunk {
+			item, err := exportActivity(zw, s, actorId, followers, tagNames[s.Id])
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+	}
+	outbox := map[string]interface{}{
+		"@context":     activityStreamsContext,
+		"id":           "outbox.json",
+		"type":         "OrderedCollection",
+		"totalItems":   len(items),
+		"orderedItems": items,
+	}
+	if err := writeZipJSON(zw, "outbox.json", outbox); err != nil {
+		return fmt.Errorf("failed to write outbox.json: %v", err)
+	}
+	actor := map[string]interface{}{
+		"@context":          []string{activityStreamsContext, "https://w3id.org/security/v1"},
+		"id":                actorId,
+		"type":              "Person",
+		"preferredUsername": account.UserName,
+		"name":              account.DisplayName,
+		"url":               account.Url,
+		"outbox":            "outbox.json",
+		"followers":         followers,
+	}
+	if account.Avatar != "" {
+		actor["icon"] = map[string]string{"type": "Image", "url": account.Avatar}
+	}
+	if err := writeZipJSON(zw, "actor.json", actor); err != nil {
+		return fmt.Errorf("failed to write actor.json: %v", err)
+	}
+	return zw.Close()
+}
+
+func exportActivity(zw *zip.Writer, s Status, actorId string, followers string, tagNames []string) (map[string]interface{}, error) {
+	statusUri := actorId + "/statuses/" + s.Id
+	to, cc := exportAudience(s.Visibility, followers)
+	published := s.CreatedAt.UTC().Format(time.RFC3339)
+	if s.Kind == StatusKindReblog {
+		return map[string]interface{}{
+			"id":        statusUri + "/activity",
+			"type":      "Announce",
+			"actor":     actorId,
+			"published": published,
+			"to":        to,
+			"cc":        cc,
+			"object":    s.ReblogOfUrl,
+		}, nil
+	}
+	tags := []map[string]string{}
+	for _, name := range tagNames {
+		tags = append(tags, map[string]string{"type": "Hashtag", "name": "#" + name, "href": "https://" + s.Host + "/tags/" + name})
+	}
+	attachments := []map[string]interface{}{}
+	for _, a := range s.MediaAttachments {
+		mediaUrl, err := writeExportMedia(zw, a)
+		if err != nil {
+			return nil, err
+		}
+		attachment := map[string]interface{}{
+			"type":      "Document",
+			"mediaType": a.ContentType,
+			"url":       mediaUrl,
+			"name":      a.Description,
+			"blurhash":  a.Blurhash,
+		}
+		if a.Width > 0 && a.Height > 0 {
+			attachment["width"] = a.Width
+			attachment["height"] = a.Height
+		}
+		attachments = append(attachments, attachment)
+	}
+	note := map[string]interface{}{
+		"id":           statusUri,
+		"type":         "Note",
+		"summary":      nilIfEmpty(s.SpoilerText),
+		"content":      s.Content,
+		"url":          s.Url,
+		"published":    published,
+		"attributedTo": actorId,
+		"to":           to,
+		"cc":           cc,
+		"sensitive":    s.Sensitive,
+		"tag":          tags,
+		"attachment":   attachments,
+		"inReplyTo":    nil,
+	}
+	if s.Content == "" {
+		note["content"] = mfmToHtml(s.Text)
+	}
+	if s.Language != "" {
+		note["contentMap"] = map[string]string{s.Language: note["content"].(string)}
+	}
+	if !s.EditedAt.IsZero() {
+		note["updated"] = s.EditedAt.UTC().Format(time.RFC3339)
+	}
+	// 他人への返信は返信先のURLが分からないので、自分への返信だけ書く
+	if s.InReplyToId != "" && s.InReplyToAccountId == s.AccountId {
+		note["inReplyTo"] = actorId + "/statuses/" + s.InReplyToId
+	}
+	return map[string]interface{}{
+		"id":        statusUri + "/activity",
+		"type":      "Create",
+		"actor":     actorId,
+		"published": published,
+		"to":        to,
+		"cc":        cc,
+		"object":    note,
+	}, nil
+}
+
+// ActivityStreamsでは値がないことをnullで表す
+func nilIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// cmd/export-archiveから呼ばれる。argsは@user@hostと書き出すzipのパス
+func ExportArchiveCommand(args []string) error {
+	if err := godotenv.Load(".env"); err != nil {
+		fmt.Println("failed to load env file")
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("usage: export-archive @user@host archive.zip")
+	}
+	user, host, ok := parseHandle(args[0])
+	if !ok {
+		return fmt.Errorf("invalid account: %s", args[0])
+	}
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	store = s
+	blobs, err = OpenBlobStore()
+	if err != nil {
+		return err
+	}
+	account, err := store.SelectAccountByUserName(user, host)
+	if err != nil {
+		return fmt.Errorf("%s is not archived: %v", args[0], err)
+	}
+	f, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	if err := exportArchive(f, account, host); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("exported %s to %s\n", args[0], args[1])
+	return nil
+}
@@ -0,0 +1,286 @@
+package activitypublog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultFeedSize = 20
+
+// フィードに載せる投稿の数
+func FeedSize() int {
+	v, err := strconv.Atoi(os.Getenv("FEED_SIZE"))
+	if err != nil || v <= 0 {
+		return defaultFeedSize
+	}
+	return v
+}
+
+// フィード全体の情報。Linkは投稿一覧のページ、SelfUrlはフィード自体のURL
+type FeedMeta struct {
+	Title   string
+	Author  string
+	Link    string
+	SelfUrl string
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	Id        string      `xml:"id"`
+	Link      atomLink    `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Guid        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+}
+
+type rssFeed struct {
+	XMLName       xml.Name  `xml:"rss"`
+	Version       string    `xml:"version,attr"`
+	Title         string    `xml:"channel>title"`
+	Link          string    `xml:"channel>link"`
+	Description   string    `xml:"channel>description"`
+	LastBuildDate string    `xml:"channel>lastBuildDate"`
+	Items         []rssItem `xml:"channel>item"`
+}
+
+// 一覧の投稿は本文のHTMLや編集日時を読んでいないので、フィードに載せる分だけ読み直す
+func loadFeedStatuses(statuses []Status) ([]Status, error) {
+	if len(statuses) > FeedSize() {
+		statuses = statuses[:FeedSize()]
+	}
+	full := make([]Status, 0, len(statuses))
+	for _, s := range statuses {
+		status, ok, err := store.SelectStatus(s.Id, s.Host)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			full = append(full, status)
+		}
+	}
+	return full, nil
+}
+
+// 編集されていれば編集日時
+func statusUpdatedAt(s Status) time.Time {
+	if !s.EditedAt.IsZero() {
+		return s.EditedAt
+	}
+	return s.CreatedAt
+}
+
+// 一番新しい投稿の更新日時。投稿がなければゼロ値
+func feedUpdatedAt(statuses []Status) time.Time {
+	var updated time.Time
+	for _, s := range statuses {
+		if t := statusUpdatedAt(s); t.After(updated) {
+			updated = t
+		}
+	}
+	return updated
+}
+
+func feedEntryTitle(s Status) string {
+	if s.Kind == StatusKindReblog {
+		return "ブースト: " + s.ReblogOfUrl
+	}
+	if s.SpoilerText != "" {
+		return s.SpoilerText
+	}
+	text := []rune(s.Text)
+	if len(text) > 50 {
+		return string(text[:50]) + "…"
+	}
+	return string(text)
+}
+
+func feedEntryContent(s Status) string {
+	if s.Kind == StatusKindReblog {
+		return fmt.Sprintf(`<p>🔁 <a href="%s">%s</a></p>`, html.EscapeString(s.ReblogOfUrl), html.EscapeString(s.ReblogOfUrl))
+	}
+	if s.Content != "" {
+		return s.Content
+	}
+	return mfmToHtml(s.Text)
+}
+
+func feedEntryUrl(s Status) string {
+	if s.Url != "" {
+		return s.Url
+	}
+	return "https://" + s.Host + "/statuses/" + s.Id
+}
+
+// statusesは新しい順。loadFeedStatusesで読み直したものを渡す
+func renderAtomFeed(meta FeedMeta, statuses []Status) ([]byte, error) {
+	feed := atomFeed{
+		Title:   meta.Title,
+		Id:      meta.Link,
+		Updated: feedUpdatedAt(statuses).UTC().Format(time.RFC3339),
+		Author:  meta.Author,
+		Links: []atomLink{
+			{Rel: "alternate", Type: "text/html", Href: meta.Link},
+			{Rel: "self", Type: "application/atom+xml", Href: meta.SelfUrl},
+		},
+	}
+	for _, s := range statuses {
+		u := feedEntryUrl(s)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:     feedEntryTitle(s),
+			Id:        u,
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: u},
+			Published: s.CreatedAt.UTC().Format(time.RFC3339),
+			Updated:   statusUpdatedAt(s).UTC().Format(time.RFC3339),
+			Content:   atomContent{Type: "html", Body: feedEntryContent(s)},
+		})
+	}
+	return marshalFeed(feed)
+}
+
+func renderRssFeed(meta FeedMeta, statuses []Status) ([]byte, error) {
+	feed := rssFeed{
+		Version:       "2.0",
+		Title:         meta.Title,
+		Link:          meta.Link,
+		Description:   meta.Title,
+		LastBuildDate: feedUpdatedAt(statuses).UTC().Format(time.RFC1123Z),
+	}
+	for _, s := range statuses {
+		u := feedEntryUrl(s)
+		feed.Items = append(feed.Items, rssItem{
+			Title:       feedEntryTitle(s),
+			Link:        u,
+			Guid:        u,
+			PubDate:     s.CreatedAt.UTC().Format(time.RFC1123Z),
+			Description: feedEntryContent(s),
+		})
+	}
+	return marshalFeed(feed)
+}
+
+func marshalFeed(feed interface{}) ([]byte, error) {
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to render feed: %v", err)
+	}
+	return append([]byte(xml.Header), append(body, '\n')...), nil
+}
+
+var feedContentTypes = map[string]string{
+	"atom": "application/atom+xml; charset=utf-8",
+	"rss":  "application/rss+xml; charset=utf-8",
+}
+
+// 公開ページのフィードの検証子。投稿の数と最後の更新時刻、見せる範囲の設定が変わらなければ中身も変わらない
+// 投稿の一覧を読むよりずっと軽いので、条件付きGETにはこれだけで答える
+func feedValidator(account Account, host string, format string) (string, time.Time, error) {
+	count, err := store.CountStatusesByAccount(account.Id, host)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	lastModified, err := store.SelectStatusesLastModified(account.Id, host)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	key := fmt.Sprintf("%s|%d|%d|%v|%v|%v|%v|%v|%d", format, count, lastModified.UnixNano(), account.ShowUnlisted, account.ShowPrivate, account.ShowDirect, account.ShowReblogs, account.ShowDeleted, FeedSize())
+	sum := sha256.Sum256([]byte(key))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`, lastModified.UTC().Truncate(time.Second), nil
+}
+
+// If-None-Matchがあればそれだけで、なければIf-Modified-Sinceで判断する
+func feedNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+			if v == etag || v == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !lastModified.IsZero() && !lastModified.After(since)
+}
+
+// 作ったフィードを検証子ごとに覚えておく。条件付きでないGETにも一覧を読み直さずに返せる
+var feedCache = struct {
+	sync.Mutex
+	entries map[string]feedCacheEntry
+}{entries: map[string]feedCacheEntry{}}
+
+type feedCacheEntry struct {
+	etag string
+	body []byte
+}
+
+func cachedFeed(key string, etag string) ([]byte, bool) {
+	feedCache.Lock()
+	defer feedCache.Unlock()
+	entry, ok := feedCache.entries[key]
+	if !ok || entry.etag != etag {
+		return nil, false
+	}
+	return entry.body, true
+}
+
+func storeFeed(key string, etag string, body []byte) {
+	feedCache.Lock()
+	defer feedCache.Unlock()
+	feedCache.entries[key] = feedCacheEntry{etag: etag, body: body}
+}
+
+// 公開ページと同じ投稿からフィードを作る
+func renderUserFeed(account Account, host string, format string) ([]byte, error) {
+	statuses, err := store.SelectStatusesByAccountWithRestriction(account.UserName, host, NewStatusFilter("", ""))
+	if err != nil {
+		return nil, err
+	}
+	statuses, err = loadFeedStatuses(statuses)
+	if err != nil {
+		return nil, err
+	}
+	link := os.Getenv("BASE_URL") + "/users/" + host + "/" + account.UserName
+	meta := FeedMeta{Title: host + "@" + account.UserName, Author: account.UserName, Link: link, SelfUrl: link + "/feed." + format}
+	if format == "rss" {
+		return renderRssFeed(meta, statuses)
+	}
+	return renderAtomFeed(meta, statuses)
+}
@@ -0,0 +1,70 @@
+package activitypublog
+
+import "github.com/sergi/go-diff/diffmatchpatch"
+
+// 差分の断片。Opはequal, insert, deleteのいずれか
+type DiffSegment struct {
+	Op   string
+	Text string
+}
+
+// 版と、その1つ前の版からの差分
+type RevisionView struct {
+	StatusRevision
+	// この版か前の版にCWがあるときだけ表示する
+	HasSpoilerText  bool
+	SpoilerTextDiff []DiffSegment
+	TextDiff        []DiffSegment
+	SensitiveDiff   bool
+}
+
+// 日本語は単語の区切りがないので文字単位で比べ、読みやすいようにまとめる
+func diffText(old string, new string) []DiffSegment {
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffCleanupSemantic(dmp.DiffMain(old, new, false))
+	segments := make([]DiffSegment, 0, len(diffs))
+	for _, d := range diffs {
+		op := "equal"
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			op = "insert"
+		case diffmatchpatch.DiffDelete:
+			op = "delete"
+		}
+		segments = append(segments, DiffSegment{Op: op, Text: d.Text})
+	}
+	return segments
+}
+
+// 古い順の版を、前の版との差分つきで新しい順に並べる。最初の版は全体を追加として扱う
+func diffRevisions(revisions []StatusRevision) []RevisionView {
+	views := make([]RevisionView, len(revisions))
+	var prev StatusRevision
+	for i, r := range revisions {
+		views[len(revisions)-1-i] = RevisionView{
+			StatusRevision:  r,
+			HasSpoilerText:  prev.SpoilerText != "" || r.SpoilerText != "",
+			SpoilerTextDiff: diffText(prev.SpoilerText, r.SpoilerText),
+			TextDiff:        diffText(prev.Text, r.Text),
+			SensitiveDiff:   i > 0 && prev.Sensitive != r.Sensitive,
+		}
+		prev = r
+	}
+	return views
+}
+
+// idの投稿と版の一覧を返す。投稿が見つからないか見せられなければokはfalse
+func loadHistory(accountId string, host string, id string, visibilities []string, filter StatusFilter) (Status, []RevisionView, bool, error) {
+	status, ok, err := store.SelectStatus(id, host)
+	if err != nil || !ok {
+		return status, nil, false, err
+	}
+	if status.AccountId != accountId || !visibleIn(status, visibilities) || !filter.allows(status) {
+		return status, nil, false, nil
+	}
+	revisions, err := store.SelectStatusRevisions(id, host)
+	if err != nil {
+		return status, nil, false, err
+	}
+	return status, diffRevisions(revisions), true, nil
+}
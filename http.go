@@ -1,130 +1,417 @@
 package activitypublog
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func hPostApp(host string, baseUrl string) (App, error) {
+// エラーはerrors.IsでErrUnauthorizedなどと比べられるよう%wで包む
+func hPostApp(ctx context.Context, host string, redirectUri string) (App, error) {
 	var app App
-	path := "https://" + host + "/api/v1/apps"
-	resp, err := http.PostForm(path, url.Values{"client_name": {"chao-activitypublog"}, "redirect_uris": {baseUrl + "/authorize"}})
-	if err != nil {
-		return app, fmt.Errorf("failed to create app for the host: %v", err)
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return app, fmt.Errorf("failed to read response from server: %v", err)
-	}
-
-	if err := json.Unmarshal(body, &app); err != nil {
-		return app, fmt.Errorf("failed to parse response from server: %v", err)
+	form := url.Values{"client_name": {"chao-activitypublog"}, "redirect_uris": {redirectUri}}
+	if _, err := mastodon.PostFormJSON(ctx, "https://"+host+"/api/v1/apps", form, &app); err != nil {
+		return app, fmt.Errorf("failed to create app for the host: %w", err)
 	}
 	app.Host = host
 	return app, nil
 }
 
-func hGetVerifyCredentials(host string, token string) (Account, error) {
+// 認可コードをアクセストークンに交換する
+func hPostOauthToken(ctx context.Context, host string, app App, code string, redirectUri string) (PostOauthTokenResponse, error) {
+	var r PostOauthTokenResponse
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {app.ClientId}, "client_secret": {app.ClientSecret}, "redirect_uri": {redirectUri}}
+	if _, err := mastodon.PostFormJSON(ctx, "https://"+host+"/oauth/token", form, &r); err != nil {
+		return r, fmt.Errorf("failed to POST oauth/token: %w", err)
+	}
+	return r, nil
+}
+
+func hGetVerifyCredentials(ctx context.Context, host string, token string) (Account, error) {
 	var account Account
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://"+host+"/api/v1/accounts/verify_credentials", nil)
-	if err != nil {
-		return account, fmt.Errorf("failed to create request: %v", err)
+	if _, err := mastodon.GetJSON(ctx, "https://"+host+"/api/v1/accounts/verify_credentials", token, &account); err != nil {
+		return account, fmt.Errorf("failed to GET verify_credentials: %w", err)
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
-	resp, err := client.Do(req)
+	return account, nil
+}
+
+// Mastodon APIのStatusエンティティ
+type hStatus struct {
+	Id                 string
+	Account            Account
+	Text               string
+	Content            string
+	SpoilerText        string `json:"spoiler_text"`
+	Sensitive          bool
+	Language           string
+	Url                string
+	CreatedAt          string `json:"created_at"`
+	Tags               []Tag
+	Visibility         string
+	EditedAt           string             `json:"edited_at"`
+	InReplyToId        string             `json:"in_reply_to_id"`
+	InReplyToAccountId string             `json:"in_reply_to_account_id"`
+	MediaAttachments   []hMediaAttachment `json:"media_attachments"`
+	Reblog             *hStatus
+}
+
+type hMediaAttachment struct {
+	Id          string
+	Type        string
+	Url         string
+	PreviewUrl  string `json:"preview_url"`
+	RemoteUrl   string `json:"remote_url"`
+	Description string
+	Blurhash    string
+	Meta        struct {
+		Original struct {
+			Width  int
+			Height int
+		}
+	}
+}
+
+type hGetAccountStatusesResponse []hStatus
+
+const defaultStatusPageLimit = 40
+
+// 1ページで取得する投稿の数。Mastodonの上限は40
+func StatusPageLimit() int {
+	v, err := strconv.Atoi(os.Getenv("STATUS_PAGE_LIMIT"))
+	if err != nil || v <= 0 || v > defaultStatusPageLimit {
+		return defaultStatusPageLimit
+	}
+	return v
+}
+
+func accountStatusesUrl(host string, id string, params url.Values) string {
+	params.Set("limit", strconv.Itoa(StatusPageLimit()))
+	return "https://" + host + "/api/v1/accounts/" + id + "/statuses?" + params.Encode()
+}
+
+// accounts/:id/statusesの1ページを取得する。linksはLinkヘッダーのrelごとのurl
+func hGetAccountStatuses(ctx context.Context, host string, token string, id string, pageUrl string) ([]Status, map[string]string, error) {
+	var statuses []Status
+	var res hGetAccountStatusesResponse
+	header, err := mastodon.GetJSON(ctx, pageUrl, token, &res)
 	if err != nil {
-		return account, fmt.Errorf("failed to GET verify_credentials: %v", err)
+		return statuses, nil, fmt.Errorf("failed to GET accounts/:id/statuses: %w", err)
+	}
+
+	for _, v := range res {
+		s, ok := v.toStatus(host, id)
+		if !ok {
+			continue
+		}
+		statuses = append(statuses, s)
+	}
+	// 次のページもトークンを付けて読むので、ほかのホストを指すリンクはたどらない
+	links := parseLinkHeader(header.Get("Link"))
+	for rel, link := range links {
+		if hostOf(link) != host {
+			delete(links, rel)
+		}
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	return statuses, links, nil
+}
+
+// created_atが読めないものはokがfalseになる
+func (v hStatus) toStatus(host string, accountId string) (Status, bool) {
+	location, _ := time.LoadLocation("Asia/Tokyo")
+	ca, err := time.Parse(time.RFC3339, v.CreatedAt)
 	if err != nil {
-		return account, fmt.Errorf("failed to read response body: %v", err)
+		return Status{}, false
 	}
-	if err := json.Unmarshal(body, &account); err != nil {
-		fmt.Printf("failed to parse account data: raw data: %v", body)
-		return account, fmt.Errorf("failed to parse account data: %v", err)
+	// edited_atは編集されていない投稿ではnull
+	var ea time.Time
+	if v.EditedAt != "" {
+		ea, _ = time.Parse(time.RFC3339, v.EditedAt)
 	}
-	return account, nil
+	kind := StatusKindPost
+	var reblogOfId, reblogOfUrl, reblogAuthorAcct, reblogAuthorName string
+	// ブーストは本文が空で、元の投稿がreblogに入っている。本文などは元の投稿のものを控えておく
+	body := v
+	if v.Reblog != nil {
+		kind = StatusKindReblog
+		body = *v.Reblog
+		reblogOfId = body.Id
+		reblogOfUrl = body.Url
+		reblogAuthorAcct = body.Account.Acct
+		reblogAuthorName = body.Account.DisplayName
+	}
+	// textは削除して書き直すときにしか返ってこないので、普段はcontentから作る
+	text := body.Text
+	if text == "" {
+		text = htmlToText(body.Content)
+	}
+	return Status{
+		Id:                 v.Id,
+		Account:            v.Account,
+		Text:               text,
+		Content:            body.Content,
+		SpoilerText:        body.SpoilerText,
+		Sensitive:          body.Sensitive,
+		Language:           body.Language,
+		Url:                httpUrlOrEmpty(v.Url),
+		CreatedAt:          ca.In(location),
+		Tags:               v.Tags,
+		Host:               host,
+		AccountId:          accountId,
+		Visibility:         v.Visibility,
+		EditedAt:           ea,
+		InReplyToId:        v.InReplyToId,
+		InReplyToAccountId: v.InReplyToAccountId,
+		MediaAttachments:   toMediaAttachments(host, v.Id, body.MediaAttachments),
+		Kind:               kind,
+		ReblogOfId:         reblogOfId,
+		ReblogOfUrl:        httpUrlOrEmpty(reblogOfUrl),
+		ReblogAuthorAcct:   reblogAuthorAcct,
+		ReblogAuthorName:   reblogAuthorName,
+	}, true
 }
 
-type hGetAccountStatusesResponse []struct {
-	Id         string
-	Account    Account
-	Text       string
-	Url        string
-	CreatedAt  string `json:"created_at"`
-	Tags       []Tag
-	Visibility string
+func toMediaAttachments(host string, statusId string, attachments []hMediaAttachment) []MediaAttachment {
+	var media []MediaAttachment
+	for i, m := range attachments {
+		// 他サーバーの投稿ではurlがこのサーバーのキャッシュで、remote_urlが元のファイル
+		remoteUrl := m.Url
+		if m.RemoteUrl != "" {
+			remoteUrl = m.RemoteUrl
+		}
+		media = append(media, MediaAttachment{
+			Id:          m.Id,
+			Host:        host,
+			StatusId:    statusId,
+			Position:    i,
+			Type:        m.Type,
+			Description: m.Description,
+			Blurhash:    m.Blurhash,
+			RemoteUrl:   remoteUrl,
+			PreviewUrl:  m.PreviewUrl,
+			Width:       m.Meta.Original.Width,
+			Height:      m.Meta.Original.Height,
+		})
+	}
+	return media
 }
 
-func hGetAccountStatuses(host string, token string, id string, params string) ([]Status, error) {
-	var statuses []Status
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://"+host+"/api/v1/accounts/"+id+"/statuses?"+params, nil)
+func (v hStatus) toRemoteStatus(host string) (RemoteStatus, bool) {
+	ca, err := time.Parse(time.RFC3339, v.CreatedAt)
 	if err != nil {
-		return statuses, fmt.Errorf("failed to create request: %v", err)
+		return RemoteStatus{}, false
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
-	resp, err := client.Do(req)
-	if err != nil {
-		return statuses, fmt.Errorf("failed to GET accounts/:id/statuses: %v", err)
+	var ea time.Time
+	if v.EditedAt != "" {
+		ea, _ = time.Parse(time.RFC3339, v.EditedAt)
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	return RemoteStatus{
+		Id:               v.Id,
+		Host:             host,
+		AuthorId:         v.Account.Id,
+		AuthorAcct:       v.Account.Acct,
+		AuthorName:       v.Account.DisplayName,
+		AuthorUrl:        httpUrlOrEmpty(v.Account.Url),
+		Text:             htmlToText(v.Content),
+		Content:          v.Content,
+		SpoilerText:      v.SpoilerText,
+		Sensitive:        v.Sensitive,
+		Language:         v.Language,
+		Url:              httpUrlOrEmpty(v.Url),
+		CreatedAt:        ca,
+		Visibility:       v.Visibility,
+		EditedAt:         ea,
+		MediaAttachments: toMediaAttachments(host, v.Id, v.MediaAttachments),
+	}, true
+}
+
+var linkPattern = regexp.MustCompile(`<([^>]*)>\s*;\s*rel="([^"]*)"`)
+
+// Linkヘッダーをrelごとのurlにする
+func parseLinkHeader(header string) map[string]string {
+	links := map[string]string{}
+	for _, m := range linkPattern.FindAllStringSubmatch(header, -1) {
+		links[m[2]] = m[1]
+	}
+	return links
+}
+
+var savedStatusesPaths = map[string]string{
+	SavedKindFavourite: "/api/v1/favourites",
+	SavedKindBookmark:  "/api/v1/bookmarks",
+}
+
+// お気に入り・ブックマークを1ページ取得する。pageUrlが空なら最新のページ
+// ページはお気に入りした順で投稿のidとは関係ないので、次のページはLinkヘッダーのnextに従う。最後のページならnextは空
+func hGetSavedStatuses(ctx context.Context, host string, token string, kind string, pageUrl string) ([]RemoteStatus, string, error) {
+	var statuses []RemoteStatus
+	if pageUrl == "" {
+		pageUrl = "https://" + host + savedStatusesPaths[kind] + "?limit=" + strconv.Itoa(StatusPageLimit())
+	}
+	var res []hStatus
+	header, err := mastodon.GetJSON(ctx, pageUrl, token, &res)
 	if err != nil {
-		return statuses, fmt.Errorf("failed to read response body: %v", err)
+		return statuses, "", fmt.Errorf("failed to GET %s: %w", savedStatusesPaths[kind], err)
 	}
-	var res hGetAccountStatusesResponse
-	if err := json.Unmarshal(body, &res); err != nil {
-		fmt.Printf("failed to parse account data: raw data: %v", body)
-		return statuses, fmt.Errorf("failed to parse account data: %v", err)
+	for _, v := range res {
+		s, ok := v.toRemoteStatus(host)
+		if !ok {
+			continue
+		}
+		statuses = append(statuses, s)
+	}
+	next := ""
+	if len(res) > 0 {
+		next = parseLinkHeader(header.Get("Link"))["next"]
 	}
+	return statuses, next, nil
+}
 
-	location, _ := time.LoadLocation("Asia/Tokyo")
+// Mastodon APIのStatusEditエンティティ
+type hStatusEdit struct {
+	Content     string
+	SpoilerText string `json:"spoiler_text"`
+	Sensitive   bool
+	CreatedAt   string `json:"created_at"`
+}
+
+// 編集された投稿の過去の版を古い順に取得する。最初の要素は元の投稿
+func hGetStatusHistory(ctx context.Context, host string, token string, id string) ([]StatusRevision, error) {
+	var revisions []StatusRevision
+	var res []hStatusEdit
+	if _, err := mastodon.GetJSON(ctx, "https://"+host+"/api/v1/statuses/"+id+"/history", token, &res); err != nil {
+		return revisions, fmt.Errorf("failed to GET statuses/:id/history: %w", err)
+	}
+	now := time.Now().UTC()
 	for _, v := range res {
 		ca, err := time.Parse(time.RFC3339, v.CreatedAt)
 		if err != nil {
 			continue
 		}
-		s := Status{
-			Id:         v.Id,
-			Account:    v.Account,
-			Text:       v.Text,
-			Url:        v.Url,
-			CreatedAt:  ca.In(location),
-			Tags:       v.Tags,
-			Host:       host,
-			AccountId:  id,
-			Visibility: v.Visibility,
+		revisions = append(revisions, StatusRevision{
+			StatusId:    id,
+			Host:        host,
+			RevisedAt:   ca.UTC(),
+			Text:        htmlToText(v.Content),
+			Content:     v.Content,
+			SpoilerText: v.SpoilerText,
+			Sensitive:   v.Sensitive,
+			ObservedAt:  now,
+		})
+	}
+	return revisions, nil
+}
+
+// ストリーミングAPIのホスト。インスタンス情報にあればそれを、なければAPIと同じホストを使う
+func hGetStreamingBaseUrl(ctx context.Context, host string) (string, error) {
+	var instance struct {
+		Urls struct {
+			StreamingApi string `json:"streaming_api"`
 		}
-		statuses = append(statuses, s)
 	}
-	return statuses, nil
+	if _, err := mastodon.GetJSON(ctx, "https://"+host+"/api/v1/instance", "", &instance); err != nil {
+		return "", fmt.Errorf("failed to GET instance: %w", err)
+	}
+	base := instance.Urls.StreamingApi
+	if base == "" {
+		return "https://" + host, nil
+	}
+	// streaming_apiはwss://で返るが、SSEはhttpsで同じ場所につながる
+	base = strings.Replace(base, "wss://", "https://", 1)
+	base = strings.Replace(base, "ws://", "http://", 1)
+	return strings.TrimSuffix(base, "/"), nil
 }
 
-func hGetAccountStatusesOlderThan(host string, token string, id string, maxId string) ([]Status, error) {
-	return hGetAccountStatuses(host, token, id, "max_id="+maxId)
+// userストリームにSSEで接続する。呼び出し側で本文を閉じること
+func hOpenUserStream(ctx context.Context, baseUrl string, token string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", baseUrl+"/api/v1/streaming/user", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Accept", "text/event-stream")
+	resp, err := streamingClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to streaming: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1000))
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to connect to streaming: %w", &APIError{StatusCode: resp.StatusCode, Method: req.Method, Url: req.URL.Redacted(), Body: string(body)})
+	}
+	return resp.Body, nil
 }
 
-func hGetAccountStatusesAll(host string, token string, id string, minId string, maxId string) ([]Status, error) {
+// メディアのファイルをダウンロードする。Content-Typeが返らなければ空文字
+func hGetMedia(ctx context.Context, url string) (io.ReadCloser, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %v", err)
+	}
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to GET media: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("failed to GET media: status %d", resp.StatusCode)
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
+
+// maxIdより古い投稿を1ページ分、新しい順に取得する。maxIdが空なら最新のページ
+// pageがあれば前のページのrel="next"なので、maxIdの代わりにそれを読む。nextはこのページのrel="next"
+func hGetAccountStatusesOlderThan(ctx context.Context, host string, token string, id string, maxId string, page string) ([]Status, string, error) {
+	if page == "" {
+		params := url.Values{}
+		if maxId != "" {
+			params.Set("max_id", maxId)
+		}
+		page = accountStatusesUrl(host, id, params)
+	}
+	statuses, links, err := hGetAccountStatuses(ctx, host, token, id, page)
+	if err != nil || len(statuses) == 0 {
+		return statuses, "", err
+	}
+	return statuses, links["next"], nil
+}
+
+// minIdより新しい投稿をすべて取得する。minIdが空ならすべての投稿
+// min_idのページはminIdのすぐ上の分を返すので、rel="prev"をたどって新しい方へ進む
+// minIdがなければ最新のページからrel="next"をたどって古い方へ進む
+// ページの間隔はクライアントがレート制限に合わせて空ける
+func hGetAccountStatusesNewerThan(ctx context.Context, host string, token string, id string, minId string) ([]Status, error) {
 	var statuses []Status
-	for {
-		s, err := hGetAccountStatuses(host, token, id, "max_id="+maxId+"&min_id="+minId)
+	params := url.Values{}
+	rel := "next"
+	if minId != "" {
+		params.Set("min_id", minId)
+		rel = "prev"
+	}
+	seen := map[string]bool{}
+	pageUrl := accountStatusesUrl(host, id, params)
+	for pageUrl != "" {
+		page, links, err := hGetAccountStatuses(ctx, host, token, id, pageUrl)
 		if err != nil {
 			return statuses, err
 		}
-		if len(s) == 0 {
+		if len(page) == 0 {
 			break
 		}
-		statuses = append(statuses, s...)
-		maxId = s[len(s)-1].Id
-		time.Sleep(time.Second * 2)
+		for _, s := range page {
+			if seen[s.Id] {
+				continue
+			}
+			seen[s.Id] = true
+			statuses = append(statuses, s)
+		}
+		pageUrl = links[rel]
 	}
 	return statuses, nil
 }
@@ -0,0 +1,281 @@
+package activitypublog
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// accounts/:id/statusesのページ。Linkの{base}はサーバーのURLに置き換える
+type fakeStatusesPage struct {
+	ids  []string
+	link string
+}
+
+// クエリ文字列ごとにページを返すMastodonのふり。受けたクエリを順に記録する
+func newFakeStatusesServer(t *testing.T, pages map[string]fakeStatusesPage) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var queries []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/accounts/1/statuses" || r.Header.Get("Authorization") != "Bearer token" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		page, ok := pages[r.URL.RawQuery]
+		if !ok {
+			t.Errorf("unexpected query: %s", r.URL.RawQuery)
+		}
+		if page.link != "" {
+			w.Header().Set("Link", strings.ReplaceAll(page.link, "{base}", "https://"+r.Host+r.URL.Path))
+		}
+		body := []map[string]string{}
+		for _, id := range page.ids {
+			body = append(body, map[string]string{"id": id, "created_at": "2024-01-02T03:04:05Z", "content": "<p>" + id + "</p>", "visibility": "public"})
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(srv.Close)
+	// APIはhttps://hostで呼ぶので、テスト用の証明書を信頼するクライアントに差し替える
+	saved := mastodon
+	mastodon = newMastodonClient(srv.Client())
+	t.Cleanup(func() { mastodon = saved })
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, queries...)
+	}
+}
+
+func fakeHost(srv *httptest.Server) string {
+	u, _ := url.Parse(srv.URL)
+	return u.Host
+}
+
+func TestParseLinkHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]string
+	}{
+		{"", map[string]string{}},
+		{`<https://example.com/api/v1/accounts/1/statuses?max_id=100>; rel="next", <https://example.com/api/v1/accounts/1/statuses?min_id=200>; rel="prev"`,
+			map[string]string{"next": "https://example.com/api/v1/accounts/1/statuses?max_id=100", "prev": "https://example.com/api/v1/accounts/1/statuses?min_id=200"}},
+		{`<https://example.com/a?min_id=1>;rel="prev"`, map[string]string{"prev": "https://example.com/a?min_id=1"}},
+		{`https://example.com/a; rel="next"`, map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := parseLinkHeader(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLinkHeader(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestStatusPageLimit(t *testing.T) {
+	tests := []struct {
+		env  string
+		want int
+	}{
+		{"", 40},
+		{"10", 10},
+		{"40", 40},
+		{"41", 40},
+		{"0", 40},
+		{"-1", 40},
+		{"abc", 40},
+	}
+	for _, tt := range tests {
+		t.Setenv("STATUS_PAGE_LIMIT", tt.env)
+		if got := StatusPageLimit(); got != tt.want {
+			t.Errorf("STATUS_PAGE_LIMIT=%q: got %d, want %d", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestGetAccountStatusesNewerThan(t *testing.T) {
+	tests := []struct {
+		name        string
+		pageLimit   string
+		minId       string
+		pages       map[string]fakeStatusesPage
+		wantIds     []string
+		wantQueries []string
+	}{
+		{
+			name: "follows rel=next from the newest page without min_id",
+			pages: map[string]fakeStatusesPage{
+				"limit=40":            {ids: []string{"105", "104"}, link: `<{base}?limit=40&max_id=104>; rel="next", <{base}?limit=40&min_id=105>; rel="prev"`},
+				"limit=40&max_id=104": {ids: []string{"103", "102"}, link: `<{base}?limit=40&max_id=102>; rel="next"`},
+				"limit=40&max_id=102": {},
+			},
+			wantIds:     []string{"105", "104", "103", "102"},
+			wantQueries: []string{"limit=40", "limit=40&max_id=104", "limit=40&max_id=102"},
+		},
+		{
+			name:  "follows rel=prev from min_id",
+			minId: "100",
+			pages: map[string]fakeStatusesPage{
+				"limit=40&min_id=100": {ids: []string{"102", "101"}, link: `<{base}?limit=40&max_id=101>; rel="next", <{base}?limit=40&min_id=102>; rel="prev"`},
+				"limit=40&min_id=102": {ids: []string{"104", "103"}, link: `<{base}?limit=40&min_id=104>; rel="prev"`},
+				"limit=40&min_id=104": {},
+			},
+			wantIds:     []string{"102", "101", "104", "103"},
+			wantQueries: []string{"limit=40&min_id=100", "limit=40&min_id=102", "limit=40&min_id=104"},
+		},
+		{
+			name:  "stops when a page has no link",
+			minId: "100",
+			pages: map[string]fakeStatusesPage{
+				"limit=40&min_id=100": {ids: []string{"101"}},
+			},
+			wantIds:     []string{"101"},
+			wantQueries: []string{"limit=40&min_id=100"},
+		},
+		{
+			name:  "drops statuses repeated on overlapping pages",
+			minId: "100",
+			pages: map[string]fakeStatusesPage{
+				"limit=40&min_id=100": {ids: []string{"103", "102", "101"}, link: `<{base}?limit=40&min_id=102>; rel="prev"`},
+				"limit=40&min_id=102": {ids: []string{"104", "103"}, link: `<{base}?limit=40&min_id=104>; rel="prev"`},
+				"limit=40&min_id=104": {},
+			},
+			wantIds:     []string{"103", "102", "101", "104"},
+			wantQueries: []string{"limit=40&min_id=100", "limit=40&min_id=102", "limit=40&min_id=104"},
+		},
+		{
+			name:      "uses STATUS_PAGE_LIMIT for the first page",
+			pageLimit: "2",
+			minId:     "100",
+			pages: map[string]fakeStatusesPage{
+				"limit=2&min_id=100": {ids: []string{"102", "101"}, link: `<{base}?limit=2&min_id=102>; rel="prev"`},
+				"limit=2&min_id=102": {},
+			},
+			wantIds:     []string{"102", "101"},
+			wantQueries: []string{"limit=2&min_id=100", "limit=2&min_id=102"},
+		},
+		{
+			name:      "clamps STATUS_PAGE_LIMIT to the Mastodon maximum",
+			pageLimit: "100",
+			minId:     "100",
+			pages: map[string]fakeStatusesPage{
+				"limit=40&min_id=100": {},
+			},
+			wantIds:     nil,
+			wantQueries: []string{"limit=40&min_id=100"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("STATUS_PAGE_LIMIT", tt.pageLimit)
+			srv, queries := newFakeStatusesServer(t, tt.pages)
+			statuses, err := hGetAccountStatusesNewerThan(ctx, fakeHost(srv), "token", "1", tt.minId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, s := range statuses {
+				ids = append(ids, s.Id)
+				if s.Host != fakeHost(srv) || s.AccountId != "1" {
+					t.Errorf("status %s has host %s, account %s", s.Id, s.Host, s.AccountId)
+				}
+			}
+			if !reflect.DeepEqual(ids, tt.wantIds) {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIds)
+			}
+			if got := queries(); !reflect.DeepEqual(got, tt.wantQueries) {
+				t.Errorf("queries = %v, want %v", got, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestGetAccountStatusesNewerThanError(t *testing.T) {
+	srv, _ := newFakeStatusesServer(t, nil)
+	// 他のアカウントのパスは404になる
+	_, err := hGetAccountStatusesNewerThan(ctx, fakeHost(srv), "token", "2", "")
+	if err == nil {
+		t.Fatal("want error")
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestGetAccountStatusesOlderThan(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxId       string
+		pages       map[string]fakeStatusesPage
+		wantIds     []string
+		wantQueries []string
+	}{
+		{
+			name:  "follows rel=next across pages from max_id",
+			maxId: "110",
+			pages: map[string]fakeStatusesPage{
+				"limit=40&max_id=110": {ids: []string{"109", "108"}, link: `<{base}?limit=40&max_id=108>; rel="next", <{base}?limit=40&min_id=109>; rel="prev"`},
+				// 次のページはサーバーが決めるので、最後の投稿のidと違っていてもLinkのほうに従う
+				"limit=40&max_id=108": {ids: []string{"107", "106"}, link: `<{base}?limit=40&max_id=105>; rel="next"`},
+				"limit=40&max_id=105": {},
+			},
+			wantIds:     []string{"109", "108", "107", "106"},
+			wantQueries: []string{"limit=40&max_id=110", "limit=40&max_id=108", "limit=40&max_id=105"},
+		},
+		{
+			name: "starts from the newest page without max_id",
+			pages: map[string]fakeStatusesPage{
+				"limit=40":            {ids: []string{"102", "101"}, link: `<{base}?limit=40&max_id=101>; rel="next"`},
+				"limit=40&max_id=101": {},
+			},
+			wantIds:     []string{"102", "101"},
+			wantQueries: []string{"limit=40", "limit=40&max_id=101"},
+		},
+		{
+			name:  "does not follow a link to another host",
+			maxId: "110",
+			pages: map[string]fakeStatusesPage{
+				"limit=40&max_id=110": {ids: []string{"109"}, link: `<https://other.example/api/v1/accounts/1/statuses?max_id=109>; rel="next"`},
+			},
+			wantIds:     []string{"109"},
+			wantQueries: []string{"limit=40&max_id=110"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("STATUS_PAGE_LIMIT", "")
+			srv, queries := newFakeStatusesServer(t, tt.pages)
+			// バックフィルと同じく、返ったnextがなくなるか空のページになるまで読む
+			var ids []string
+			page := ""
+			for i := 0; i < 10; i++ {
+				statuses, next, err := hGetAccountStatusesOlderThan(ctx, fakeHost(srv), "token", "1", tt.maxId, page)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, s := range statuses {
+					ids = append(ids, s.Id)
+				}
+				if len(statuses) == 0 && next != "" {
+					t.Errorf("empty page has next %s", next)
+				}
+				if next == "" {
+					break
+				}
+				page = next
+			}
+			if !reflect.DeepEqual(ids, tt.wantIds) {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIds)
+			}
+			if got := queries(); !reflect.DeepEqual(got, tt.wantQueries) {
+				t.Errorf("queries = %v, want %v", got, tt.wantQueries)
+			}
+		})
+	}
+}
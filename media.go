@@ -0,0 +1,186 @@
+package activitypublog
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// これ以上失敗したメディアはダウンロードを諦める
+const maxMediaDownloadAttempts = 5
+
+// ダウンロードしたファイルは/mediaで公開されるので、内部のアドレスからは取ってこない
+func archiveMediaAttachment(ctx context.Context, attachment MediaAttachment) (MediaAttachment, error) {
+	attachment.DownloadAttempts++
+	if _, err := checkRemoteUrl(attachment.RemoteUrl); err != nil {
+		return attachment, err
+	}
+	body, contentType, err := hGetMedia(ctx, attachment.RemoteUrl)
+	if err != nil {
+		return attachment, err
+	}
+	defer body.Close()
+	key, err := blobs.Put(body)
+	if err != nil {
+		return attachment, err
+	}
+	attachment.BlobKey = key
+	attachment.ContentType = contentType
+	return attachment, nil
+}
+
+// 1件も保存できない状態が続いたときに待つ時間の上限
+const maxMediaArchiverBackoff = time.Hour
+
+// 保存できなかった回数に応じて待つ時間を延ばす
+func mediaArchiverBackoff(interval time.Duration, failures int) time.Duration {
+	wait := interval
+	for i := 0; i < failures && wait < maxMediaArchiverBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxMediaArchiverBackoff {
+		return maxMediaArchiverBackoff
+	}
+	return wait
+}
+
+// まだ保存していないメディアのファイルをダウンロードしてBlobStoreに保存し続ける
+// 1件でも保存できたらすぐに次を取りに行き、1件も保存できなければ間隔を延ばして待つ
+func StartMediaArchiver(ctx context.Context, interval time.Duration) {
+	failures := 0
+	for {
+		attachments, err := store.SelectPendingMediaAttachments(50, maxMediaDownloadAttempts)
+		if err != nil {
+			fmt.Printf("media archiver: %v\n", err)
+		}
+		progressed := false
+		for _, attachment := range attachments {
+			if ctx.Err() != nil {
+				return
+			}
+			result, err := archiveMediaAttachment(ctx, attachment)
+			if err != nil {
+				fmt.Printf("media archiver: %s@%s: %v\n", attachment.Id, attachment.Host, err)
+			}
+			if err := store.UpdateMediaAttachmentBlob(result); err != nil {
+				fmt.Printf("media archiver: %v\n", err)
+				continue
+			}
+			if result.BlobKey != "" {
+				progressed = true
+			}
+		}
+		wait := interval
+		if len(attachments) > 0 {
+			if progressed {
+				failures = 0
+				continue
+			}
+			failures++
+			wait = mediaArchiverBackoff(interval, failures)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// 公開ページに出ている投稿の添付か
+func mediaIsPublic(attachments []MediaAttachment) (bool, error) {
+	for _, a := range attachments {
+		status, ok, err := store.SelectStatus(a.StatusId, a.Host)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+		account, err := store.SelectAccount(status.AccountId, status.Host)
+		if err != nil {
+			return false, err
+		}
+		if account.Public && visibleIn(status, account.PublicVisibilities()) && account.PublicFilter(StatusFilter{}).allows(status) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// accountIdの投稿か、accountIdがお気に入り・ブックマークした投稿の添付か
+func mediaIsOwnedBy(attachments []MediaAttachment, accountId string, host string) (bool, error) {
+	for _, a := range attachments {
+		if a.Host != host {
+			continue
+		}
+		status, ok, err := store.SelectStatus(a.StatusId, a.Host)
+		if err != nil {
+			return false, err
+		}
+		if ok && status.AccountId == accountId {
+			return true, nil
+		}
+		for _, kind := range []string{SavedKindFavourite, SavedKindBookmark} {
+			saved, err := store.SelectSavedStatusIds(accountId, host, kind, []string{a.StatusId})
+			if err != nil {
+				return false, err
+			}
+			if saved[a.StatusId] {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// /mediaを見ている人。ログインのcookieか個人用アクセストークンがなければokはfalse
+func mediaViewer(c echo.Context) (string, string, bool, error) {
+	if token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer "); strings.HasPrefix(token, personalAccessTokenPrefix) {
+		pat, ok, err := store.SelectPersonalAccessTokenByHash(hashPersonalAccessToken(token))
+		if err != nil || !ok {
+			return "", "", false, err
+		}
+		return pat.AccountId, pat.Host, true, nil
+	}
+	tokenCookie, err := c.Cookie("token")
+	if err != nil {
+		return "", "", false, nil
+	}
+	hostCookie, err := c.Cookie("host")
+	if err != nil {
+		return "", "", false, nil
+	}
+	// cookieが古いか壊れていても、ログインしていないのと同じに扱う
+	account, err := verifyCredentials(c.Request().Context(), hostCookie.Value, tokenCookie.Value)
+	if err != nil {
+		fmt.Printf("media viewer: %v\n", err)
+		return "", "", false, nil
+	}
+	return account.Id, hostCookie.Value, true, nil
+}
+
+// 表示用に投稿へメディアを紐づける
+func attachMedia(statuses []Status) ([]Status, error) {
+	idsByHost := map[string][]string{}
+	for _, s := range statuses {
+		idsByHost[s.Host] = append(idsByHost[s.Host], s.Id)
+	}
+	mediaByStatus := map[string][]MediaAttachment{}
+	for host, ids := range idsByHost {
+		attachments, err := store.SelectMediaAttachmentsByStatuses(host, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range attachments {
+			mediaByStatus[host+"/"+a.StatusId] = append(mediaByStatus[host+"/"+a.StatusId], a)
+		}
+	}
+	for i, s := range statuses {
+		statuses[i].MediaAttachments = mediaByStatus[s.Host+"/"+s.Id]
+	}
+	return statuses, nil
+}
@@ -0,0 +1,24 @@
+package activitypublog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMediaArchiverBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, 2 * time.Minute},
+		{3, 8 * time.Minute},
+		{6, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := mediaArchiverBackoff(time.Minute, tt.failures); got != tt.want {
+			t.Errorf("mediaArchiverBackoff(1m, %d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package activitypublog
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+)
+
+// 番号順に適用されるスキーマ変更。適用済みの番号はschema_migrationsに記録される
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db bun.IDB) error
+	Down    func(ctx context.Context, db bun.IDB) error
+}
+
+type SchemaMigration struct {
+	bun.BaseModel `bun:"table:schema_migrations"`
+	Version       int `bun:",pk"`
+	Name          string
+	AppliedAt     time.Time
+}
+
+type MigrationState struct {
+	Migration Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+func (s *bunStore) appliedMigrations() (map[int]SchemaMigration, error) {
+	if _, err := s.db.NewCreateTable().Model((*SchemaMigration)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+	var rows []SchemaMigration
+	if err := s.db.NewSelect().Model(&rows).Scan(ctx); err != nil {
+		return nil, fmt.Errorf("failed to select schema_migrations: %v", err)
+	}
+	applied := make(map[int]SchemaMigration, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// 未適用のマイグレーションを番号順にすべて適用し、適用したものを返す
+func (s *bunStore) Migrate() ([]Migration, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err := s.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			if err := m.Up(ctx, tx); err != nil {
+				return err
+			}
+			_, err := tx.NewInsert().Model(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()}).Exec(ctx)
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d %s failed: %v", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// 最後に適用したマイグレーションを1つ戻す。戻すものがなければokはfalse
+func (s *bunStore) RollbackMigration() (Migration, bool, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return Migration{}, false, err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		err := s.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			if err := m.Down(ctx, tx); err != nil {
+				return err
+			}
+			_, err := tx.NewDelete().Model((*SchemaMigration)(nil)).Where("version = ?", m.Version).Exec(ctx)
+			return err
+		})
+		if err != nil {
+			return m, false, fmt.Errorf("rollback %d %s failed: %v", m.Version, m.Name, err)
+		}
+		return m, true, nil
+	}
+	return Migration{}, false, nil
+}
+
+func (s *bunStore) MigrationStatus() ([]MigrationState, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var states []MigrationState
+	for _, m := range migrations {
+		r, ok := applied[m.Version]
+		states = append(states, MigrationState{Migration: m, Applied: ok, AppliedAt: r.AppliedAt})
+	}
+	return states, nil
+}
+
+// 既存テーブルにmodelの列を追加する。後でモデルを変えても結果が変わらないよう、modelにはマイグレーションごとに固定した構造体を渡す
+// 途中で失敗したマイグレーションをやり直せるよう、すでにある列は飛ばす
+func addColumns(ctx context.Context, db bun.IDB, model interface{}, columns ...string) error {
+	table := db.Dialect().Tables().Get(reflect.TypeOf(model))
+	for _, column := range columns {
+		field, ok := table.FieldMap[column]
+		if !ok {
+			return fmt.Errorf("no column %s in %s", column, table.Name)
+		}
+		exists, err := columnExists(ctx, db, table.Name, column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.NewAddColumn().Model(model).ColumnExpr("? "+field.CreateTableSQLType, bun.Ident(column)).Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func columnExists(ctx context.Context, db bun.IDB, table string, column string) (bool, error) {
+	query := "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+	if db.Dialect().Name() == dialect.MySQL {
+		query = "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, query, table, column).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check column %s.%s: %v", table, column, err)
+	}
+	return count > 0, nil
+}
+
+// MySQLにはCREATE INDEX IF NOT EXISTSがないので、あるかどうかを調べてから作る
+func createIndex(ctx context.Context, db bun.IDB, q *bun.CreateIndexQuery, table string, index string) error {
+	exists, err := indexExists(ctx, db, table, index)
+	if err != nil || exists {
+		return err
+	}
+	_, err = q.Index(index).Exec(ctx)
+	return err
+}
+
+func indexExists(ctx context.Context, db bun.IDB, table string, index string) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?"
+	if db.Dialect().Name() == dialect.MySQL {
+		query = "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?"
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, query, table, index).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check index %s on %s: %v", index, table, err)
+	}
+	return count > 0, nil
+}
+
+func dropColumns(ctx context.Context, db bun.IDB, model interface{}, columns ...string) error {
+	for _, column := range columns {
+		if _, err := db.NewDropColumn().Model(model).Column(column).Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropTables(ctx context.Context, db bun.IDB, models ...interface{}) error {
+	for _, model := range models {
+		if _, err := db.NewDropTable().Model(model).IfExists().Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cmd/migrateから呼ばれる。argsはup, down, statusのいずれか
+func MigrateCommand(args []string) error {
+	if err := godotenv.Load(".env"); err != nil {
+		fmt.Println("failed to load env file")
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: migrate up|down|status")
+	}
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	switch args[0] {
+	case "up":
+		done, err := s.Migrate()
+		for _, m := range done {
+			fmt.Printf("applied %d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Println("no pending migrations")
+		}
+	case "down":
+		m, ok, err := s.RollbackMigration()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("no applied migrations")
+			return nil
+		}
+		fmt.Printf("rolled back %d %s\n", m.Version, m.Name)
+	case "status":
+		states, err := s.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			if state.Applied {
+				fmt.Printf("%4d %-40s applied %s\n", state.Migration.Version, state.Migration.Name, state.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Printf("%4d %-40s pending\n", state.Migration.Version, state.Migration.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,568 @@
+package activitypublog
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+)
+
+// 新しいマイグレーションは末尾に追加する。適用済みのものは書き換えない
+var migrations = []Migration{
+	{Version: 1, Name: "create_initial_tables", Up: up1CreateInitialTables, Down: down1CreateInitialTables},
+	{Version: 2, Name: "add_status_edited_at", Up: up2AddStatusEditedAt, Down: down2AddStatusEditedAt},
+	{Version: 3, Name: "add_status_content", Up: up3AddStatusContent, Down: down3AddStatusContent},
+	{Version: 4, Name: "create_media_attachment", Up: up4CreateMediaAttachment, Down: down4CreateMediaAttachment},
+	{Version: 5, Name: "create_tag", Up: up5CreateTag, Down: down5CreateTag},
+	{Version: 6, Name: "add_status_in_reply_to", Up: up6AddStatusInReplyTo, Down: down6AddStatusInReplyTo},
+	{Version: 7, Name: "add_status_reblog", Up: up7AddStatusReblog, Down: down7AddStatusReblog},
+	{Version: 8, Name: "create_status_revision", Up: up8CreateStatusRevision, Down: down8CreateStatusRevision},
+	{Version: 9, Name: "add_status_deleted_at", Up: up9AddStatusDeletedAt, Down: down9AddStatusDeletedAt},
+	{Version: 10, Name: "create_saved_status", Up: up10CreateSavedStatus, Down: down10CreateSavedStatus},
+	{Version: 11, Name: "add_app_software", Up: up11AddAppSoftware, Down: down11AddAppSoftware},
+	{Version: 12, Name: "add_app_software_version", Up: up12AddAppSoftwareVersion, Down: down12AddAppSoftwareVersion},
+	{Version: 13, Name: "create_instance_actor", Up: up13CreateInstanceActor, Down: down13CreateInstanceActor},
+	{Version: 14, Name: "create_personal_access_token", Up: up14CreatePersonalAccessToken, Down: down14CreatePersonalAccessToken},
+	{Version: 15, Name: "add_status_fulltext_index", Up: up15AddStatusFulltextIndex, Down: down15AddStatusFulltextIndex},
+}
+
+// 1のテーブル定義。モデルが変わってもこのマイグレーションの結果は変わらないよう、当時の列をここに固定する
+type visibility1 struct {
+	bun.BaseModel `bun:"table:visibility"`
+	Visibility    string `bun:",pk"`
+}
+
+type app1 struct {
+	bun.BaseModel `bun:"table:app"`
+	Host          string `bun:",pk"`
+	ClientId      string
+	ClientSecret  string
+}
+
+type account1 struct {
+	bun.BaseModel `bun:"table:account"`
+	Id            string `bun:",pk"`
+	Host          string `bun:",pk"`
+	UserName      string
+	AllFetched    bool `bun:",default:true"`
+	Public        bool `bun:",default:false"`
+	ShowUnlisted  bool
+	ShowPrivate   bool
+	ShowDirect    bool
+}
+
+type status1 struct {
+	bun.BaseModel `bun:"table:status"`
+	Id            string `bun:",pk"`
+	Host          string `bun:",pk"`
+	AccountId     string
+	Text          string `bun:"type:VARCHAR(10000)"`
+	Url           string
+	CreatedAt     time.Time
+	Visibility    string
+}
+
+type credential1 struct {
+	bun.BaseModel `bun:"table:credential"`
+	AccountId     string `bun:",pk"`
+	Host          string `bun:",pk"`
+	AccessToken   string
+	UpdatedAt     time.Time
+}
+
+type syncSchedule1 struct {
+	bun.BaseModel   `bun:"table:sync_schedule"`
+	AccountId       string `bun:",pk"`
+	Host            string `bun:",pk"`
+	IntervalMinutes int
+	NextRunAt       time.Time
+	LastRunAt       time.Time `bun:",nullzero"`
+	LastError       string    `bun:"type:VARCHAR(1000)"`
+	LastFetched     int64
+}
+
+type backfillJob1 struct {
+	bun.BaseModel   `bun:"table:backfill_job"`
+	Id              int64 `bun:",pk,autoincrement"`
+	AccountId       string
+	Host            string
+	State           string
+	PagesFetched    int
+	StatusesFetched int64
+	TotalStatuses   int
+	OldestId        string
+	LastError       string `bun:"type:VARCHAR(1000)"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	StartedAt       time.Time `bun:",nullzero"`
+	FinishedAt      time.Time `bun:",nullzero"`
+}
+
+// 既存の環境ではテーブルがすでにあるので、すべてIF NOT EXISTSで作る
+func up1CreateInitialTables(ctx context.Context, db bun.IDB) error {
+	if _, err := db.NewCreateTable().Model((*visibility1)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	visibilities := []visibility1{{Visibility: "public"}, {Visibility: "unlisted"}, {Visibility: "private"}, {Visibility: "direct"}}
+	if _, err := db.NewInsert().Model(&visibilities).Ignore().Exec(ctx); err != nil {
+		return err
+	}
+	if _, err := db.NewCreateTable().Model((*app1)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	if _, err := db.NewCreateTable().Model((*account1)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	if _, err := db.NewCreateTable().Model((*status1)(nil)).ForeignKey("(`account_id`, `host`) REFERENCES account (`id`, `host`) ON DELETE CASCADE").ForeignKey("(`visibility`) REFERENCES visibility (`visibility`) ON DELETE CASCADE ON UPDATE CASCADE").IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	for _, model := range []interface{}{(*credential1)(nil), (*syncSchedule1)(nil), (*backfillJob1)(nil)} {
+		if _, err := db.NewCreateTable().Model(model).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func down1CreateInitialTables(ctx context.Context, db bun.IDB) error {
+	return dropTables(ctx, db, (*backfillJob1)(nil), (*syncSchedule1)(nil), (*credential1)(nil), (*status1)(nil), (*account1)(nil), (*app1)(nil), (*visibility1)(nil))
+}
+
+// 列を足すマイグレーションも、足した列の定義をその番号の構造体に固定する
+type status2 struct {
+	bun.BaseModel `bun:"table:status"`
+	EditedAt      time.Time `bun:",nullzero"`
+}
+
+func up2AddStatusEditedAt(ctx context.Context, db bun.IDB) error {
+	return addColumns(ctx, db, (*status2)(nil), "edited_at")
+}
+
+func down2AddStatusEditedAt(ctx context.Context, db bun.IDB) error {
+	return dropColumns(ctx, db, (*status2)(nil), "edited_at")
+}
+
+type status3 struct {
+	bun.BaseModel `bun:"table:status"`
+	Content       string `bun:"type:TEXT"`
+	SpoilerText   string `bun:"type:TEXT"`
+	Sensitive     bool
+	Language      string
+}
+
+func up3AddStatusContent(ctx context.Context, db bun.IDB) error {
+	return addColumns(ctx, db, (*status3)(nil), "content", "spoiler_text", "sensitive", "language")
+}
+
+func down3AddStatusContent(ctx context.Context, db bun.IDB) error {
+	return dropColumns(ctx, db, (*status3)(nil), "content", "spoiler_text", "sensitive", "language")
+}
+
+type mediaAttachment4 struct {
+	bun.BaseModel    `bun:"table:media_attachment"`
+	Id               string `bun:",pk"`
+	Host             string `bun:",pk"`
+	StatusId         string
+	Position         int
+	Type             string
+	Description      string `bun:"type:TEXT"`
+	Blurhash         string
+	RemoteUrl        string `bun:"type:VARCHAR(2048)"`
+	PreviewUrl       string `bun:"type:VARCHAR(2048)"`
+	Width            int
+	Height           int
+	BlobKey          string
+	ContentType      string
+	DownloadAttempts int
+}
+
+func up4CreateMediaAttachment(ctx context.Context, db bun.IDB) error {
+	if _, err := db.NewCreateTable().Model((*mediaAttachment4)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	if err := createIndex(ctx, db, db.NewCreateIndex().Model((*mediaAttachment4)(nil)).Column("host", "status_id"), "media_attachment", "media_attachment_status_idx"); err != nil {
+		return err
+	}
+	return createIndex(ctx, db, db.NewCreateIndex().Model((*mediaAttachment4)(nil)).Column("blob_key"), "media_attachment", "media_attachment_blob_key_idx")
+}
+
+func down4CreateMediaAttachment(ctx context.Context, db bun.IDB) error {
+	return dropTables(ctx, db, (*mediaAttachment4)(nil))
+}
+
+type tag5 struct {
+	bun.BaseModel `bun:"table:tag"`
+	Id            int64  `bun:",pk,autoincrement"`
+	Name          string `bun:",unique"`
+}
+
+type statusTag5 struct {
+	bun.BaseModel `bun:"table:status_tag"`
+	StatusId      string `bun:",pk"`
+	Host          string `bun:",pk"`
+	TagId         int64  `bun:",pk"`
+}
+
+// 5の時点の投稿。ブーストやAPIのタグはまだ保存していないので、タグは本文からだけ拾う
+type status5 struct {
+	bun.BaseModel `bun:"table:status"`
+	Id            string `bun:",pk"`
+	Host          string `bun:",pk"`
+	Text          string
+}
+
+// 5の時点のタグの拾い方。あとでstatusTagNamesを変えても、このマイグレーションが埋めるタグは変わらない
+var (
+	hashtagPattern5 = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_/&])#([\p{L}\p{N}_]*[\p{L}_][\p{L}\p{N}_]*)`)
+	tagNamePattern5 = regexp.MustCompile(`^[\p{L}\p{N}_]+$`)
+)
+
+func tagNames5(text string) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, m := range hashtagPattern5.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(m[1])
+		if !tagNamePattern5.MatchString(name) || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// テーブルを作り、保存済みの投稿の本文からタグを拾って埋める
+// やり直したときにすでにある行は飛ばす
+func up5CreateTag(ctx context.Context, db bun.IDB) error {
+	if _, err := db.NewCreateTable().Model((*tag5)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	if _, err := db.NewCreateTable().Model((*statusTag5)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	if err := createIndex(ctx, db, db.NewCreateIndex().Model((*statusTag5)(nil)).Column("tag_id"), "status_tag", "status_tag_tag_id_idx"); err != nil {
+		return err
+	}
+	lastHost, lastId := "", ""
+	for {
+		var statuses []status5
+		err := db.NewSelect().Model(&statuses).
+			Where("host > ? OR (host = ? AND id > ?)", lastHost, lastHost, lastId).
+			Order("host ASC", "id ASC").Limit(1000).Scan(ctx)
+		if err != nil {
+			return err
+		}
+		if len(statuses) == 0 {
+			return nil
+		}
+		namesByStatus := map[status5][]string{}
+		var names []string
+		for _, s := range statuses {
+			if tags := tagNames5(s.Text); len(tags) > 0 {
+				namesByStatus[s] = tags
+				names = append(names, tags...)
+			}
+		}
+		if len(names) > 0 {
+			newTags := make([]tag5, len(names))
+			for i, name := range names {
+				newTags[i] = tag5{Name: name}
+			}
+			if _, err := db.NewInsert().Model(&newTags).Ignore().Exec(ctx); err != nil {
+				return err
+			}
+			var tags []tag5
+			if err := db.NewSelect().Model(&tags).Where("name IN (?)", bun.In(names)).Scan(ctx); err != nil {
+				return err
+			}
+			tagIds := make(map[string]int64, len(tags))
+			for _, t := range tags {
+				tagIds[t.Name] = t.Id
+			}
+			var statusTags []statusTag5
+			for s, tags := range namesByStatus {
+				for _, name := range tags {
+					statusTags = append(statusTags, statusTag5{StatusId: s.Id, Host: s.Host, TagId: tagIds[name]})
+				}
+			}
+			if _, err := db.NewInsert().Model(&statusTags).Ignore().Exec(ctx); err != nil {
+				return err
+			}
+		}
+		last := statuses[len(statuses)-1]
+		lastHost, lastId = last.Host, last.Id
+	}
+}
+
+func down5CreateTag(ctx context.Context, db bun.IDB) error {
+	return dropTables(ctx, db, (*statusTag5)(nil), (*tag5)(nil))
+}
+
+type status6 struct {
+	bun.BaseModel      `bun:"table:status"`
+	Host               string
+	InReplyToId        string
+	InReplyToAccountId string
+}
+
+func up6AddStatusInReplyTo(ctx context.Context, db bun.IDB) error {
+	if err := addColumns(ctx, db, (*status6)(nil), "in_reply_to_id", "in_reply_to_account_id"); err != nil {
+		return err
+	}
+	return createIndex(ctx, db, db.NewCreateIndex().Model((*status6)(nil)).Column("host", "in_reply_to_id"), "status", "status_in_reply_to_idx")
+}
+
+func down6AddStatusInReplyTo(ctx context.Context, db bun.IDB) error {
+	if _, err := db.NewDropIndex().Model((*status6)(nil)).Index("status_in_reply_to_idx").Exec(ctx); err != nil {
+		return err
+	}
+	return dropColumns(ctx, db, (*status6)(nil), "in_reply_to_id", "in_reply_to_account_id")
+}
+
+type status7 struct {
+	bun.BaseModel    `bun:"table:status"`
+	Kind             string
+	ReblogOfId       string
+	ReblogOfUrl      string `bun:"type:VARCHAR(2048)"`
+	ReblogAuthorAcct string
+	ReblogAuthorName string
+}
+
+type account7 struct {
+	bun.BaseModel `bun:"table:account"`
+	ShowReblogs   bool
+}
+
+func up7AddStatusReblog(ctx context.Context, db bun.IDB) error {
+	if err := addColumns(ctx, db, (*status7)(nil), "kind", "reblog_of_id", "reblog_of_url", "reblog_author_acct", "reblog_author_name"); err != nil {
+		return err
+	}
+	if _, err := db.NewUpdate().Model((*status7)(nil)).Set("kind = ?", StatusKindPost).Where("kind IS NULL").Exec(ctx); err != nil {
+		return err
+	}
+	return addColumns(ctx, db, (*account7)(nil), "show_reblogs")
+}
+
+func down7AddStatusReblog(ctx context.Context, db bun.IDB) error {
+	if err := dropColumns(ctx, db, (*account7)(nil), "show_reblogs"); err != nil {
+		return err
+	}
+	return dropColumns(ctx, db, (*status7)(nil), "kind", "reblog_of_id", "reblog_of_url", "reblog_author_acct", "reblog_author_name")
+}
+
+type statusRevision8 struct {
+	bun.BaseModel `bun:"table:status_revision"`
+	Id            int64 `bun:",pk,autoincrement"`
+	StatusId      string
+	Host          string
+	RevisedAt     time.Time
+	Text          string `bun:"type:VARCHAR(10000)"`
+	Content       string `bun:"type:TEXT"`
+	SpoilerText   string `bun:"type:TEXT"`
+	Sensitive     bool
+	ObservedAt    time.Time
+}
+
+// テーブルを作り、保存済みの投稿を最初の版として入れておく。やり直したときはまだ入っていない版だけ入れる
+func up8CreateStatusRevision(ctx context.Context, db bun.IDB) error {
+	if _, err := db.NewCreateTable().Model((*statusRevision8)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	if err := createIndex(ctx, db, db.NewCreateIndex().Model((*statusRevision8)(nil)).Unique().Column("host", "status_id", "revised_at"), "status_revision", "status_revision_version_idx"); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "INSERT INTO status_revision (status_id, host, revised_at, text, content, spoiler_text, sensitive, observed_at) "+
+		"SELECT id, host, COALESCE(edited_at, created_at), text, content, spoiler_text, sensitive, CURRENT_TIMESTAMP FROM status "+
+		"WHERE NOT EXISTS (SELECT 1 FROM status_revision AS r WHERE r.host = status.host AND r.status_id = status.id AND r.revised_at = COALESCE(status.edited_at, status.created_at))")
+	return err
+}
+
+func down8CreateStatusRevision(ctx context.Context, db bun.IDB) error {
+	return dropTables(ctx, db, (*statusRevision8)(nil))
+}
+
+type status9 struct {
+	bun.BaseModel `bun:"table:status"`
+	DeletedAt     time.Time `bun:",nullzero"`
+}
+
+type account9 struct {
+	bun.BaseModel `bun:"table:account"`
+	ShowDeleted   bool
+}
+
+type backfillJob9 struct {
+	bun.BaseModel   `bun:"table:backfill_job"`
+	Kind            string
+	StatusesDeleted int64
+}
+
+// 削除の検出はバックフィルと同じジョブの仕組みで動かすので、ジョブに種類を持たせる
+func up9AddStatusDeletedAt(ctx context.Context, db bun.IDB) error {
+	if err := addColumns(ctx, db, (*status9)(nil), "deleted_at"); err != nil {
+		return err
+	}
+	if err := addColumns(ctx, db, (*account9)(nil), "show_deleted"); err != nil {
+		return err
+	}
+	if err := addColumns(ctx, db, (*backfillJob9)(nil), "kind", "statuses_deleted"); err != nil {
+		return err
+	}
+	_, err := db.NewUpdate().Model((*backfillJob9)(nil)).Set("kind = ?", BackfillKindFetch).Where("kind IS NULL").Exec(ctx)
+	return err
+}
+
+func down9AddStatusDeletedAt(ctx context.Context, db bun.IDB) error {
+	if err := dropColumns(ctx, db, (*backfillJob9)(nil), "kind", "statuses_deleted"); err != nil {
+		return err
+	}
+	if err := dropColumns(ctx, db, (*account9)(nil), "show_deleted"); err != nil {
+		return err
+	}
+	return dropColumns(ctx, db, (*status9)(nil), "deleted_at")
+}
+
+type remoteStatus10 struct {
+	bun.BaseModel `bun:"table:remote_status"`
+	Id            string `bun:",pk"`
+	Host          string `bun:",pk"`
+	AuthorId      string
+	AuthorAcct    string
+	AuthorName    string
+	AuthorUrl     string `bun:"type:VARCHAR(2048)"`
+	Text          string `bun:"type:VARCHAR(10000)"`
+	Content       string `bun:"type:TEXT"`
+	SpoilerText   string `bun:"type:TEXT"`
+	Sensitive     bool
+	Language      string
+	Url           string `bun:"type:VARCHAR(2048)"`
+	CreatedAt     time.Time
+	Visibility    string
+	EditedAt      time.Time `bun:",nullzero"`
+}
+
+type savedStatus10 struct {
+	bun.BaseModel `bun:"table:saved_status"`
+	Id            int64 `bun:",pk,autoincrement"`
+	AccountId     string
+	Host          string
+	Kind          string
+	StatusId      string
+	CreatedAt     time.Time
+}
+
+func up10CreateSavedStatus(ctx context.Context, db bun.IDB) error {
+	if _, err := db.NewCreateTable().Model((*remoteStatus10)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	if _, err := db.NewCreateTable().Model((*savedStatus10)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	return createIndex(ctx, db, db.NewCreateIndex().Model((*savedStatus10)(nil)).Unique().Column("account_id", "host", "kind", "status_id"), "saved_status", "saved_status_account_idx")
+}
+
+func down10CreateSavedStatus(ctx context.Context, db bun.IDB) error {
+	return dropTables(ctx, db, (*savedStatus10)(nil), (*remoteStatus10)(nil))
+}
+
+type app11 struct {
+	bun.BaseModel `bun:"table:app"`
+	Software      string
+}
+
+// これまで登録したアプリはすべてMastodonのもの
+func up11AddAppSoftware(ctx context.Context, db bun.IDB) error {
+	if err := addColumns(ctx, db, (*app11)(nil), "software"); err != nil {
+		return err
+	}
+	_, err := db.NewUpdate().Model((*app11)(nil)).Set("software = ?", SoftwareMastodon).Where("software IS NULL").Exec(ctx)
+	return err
+}
+
+func down11AddAppSoftware(ctx context.Context, db bun.IDB) error {
+	return dropColumns(ctx, db, (*app11)(nil), "software")
+}
+
+type app12 struct {
+	bun.BaseModel   `bun:"table:app"`
+	SoftwareVersion string
+}
+
+// バージョンは次にログインしたときにNodeInfoから埋める
+func up12AddAppSoftwareVersion(ctx context.Context, db bun.IDB) error {
+	return addColumns(ctx, db, (*app12)(nil), "software_version")
+}
+
+func down12AddAppSoftwareVersion(ctx context.Context, db bun.IDB) error {
+	return dropColumns(ctx, db, (*app12)(nil), "software_version")
+}
+
+type instanceActor13 struct {
+	bun.BaseModel `bun:"table:instance_actor"`
+	Id            string `bun:",pk"`
+	PrivateKey    string `bun:"type:TEXT"`
+	CreatedAt     time.Time
+}
+
+type backfillJob13 struct {
+	bun.BaseModel `bun:"table:backfill_job"`
+	NextPageUrl   string `bun:"type:VARCHAR(2048)"`
+}
+
+func up13CreateInstanceActor(ctx context.Context, db bun.IDB) error {
+	if _, err := db.NewCreateTable().Model((*instanceActor13)(nil)).IfNotExists().Exec(ctx); err != nil {
+		return err
+	}
+	return addColumns(ctx, db, (*backfillJob13)(nil), "next_page_url")
+}
+
+func down13CreateInstanceActor(ctx context.Context, db bun.IDB) error {
+	if err := dropColumns(ctx, db, (*backfillJob13)(nil), "next_page_url"); err != nil {
+		return err
+	}
+	return dropTables(ctx, db, (*instanceActor13)(nil))
+}
+
+type personalAccessToken14 struct {
+	bun.BaseModel `bun:"table:personal_access_token"`
+	Id            int64 `bun:",pk,autoincrement"`
+	AccountId     string
+	Host          string
+	Name          string
+	TokenHash     string `bun:",unique"`
+	CreatedAt     time.Time
+	LastUsedAt    time.Time `bun:",nullzero"`
+}
+
+func up14CreatePersonalAccessToken(ctx context.Context, db bun.IDB) error {
+	_, err := db.NewCreateTable().Model((*personalAccessToken14)(nil)).IfNotExists().Exec(ctx)
+	return err
+}
+
+func down14CreatePersonalAccessToken(ctx context.Context, db bun.IDB) error {
+	return dropTables(ctx, db, (*personalAccessToken14)(nil))
+}
+
+// 日本語は空白で区切られないのでngramパーサーを使う。SQLiteにはないので検索はLIKEのまま
+func up15AddStatusFulltextIndex(ctx context.Context, db bun.IDB) error {
+	if db.Dialect().Name() != dialect.MySQL {
+		return nil
+	}
+	exists, err := indexExists(ctx, db, "status", "status_text_fulltext_idx")
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "ALTER TABLE status ADD FULLTEXT INDEX status_text_fulltext_idx (text, spoiler_text) WITH PARSER ngram")
+	return err
+}
+
+func down15AddStatusFulltextIndex(ctx context.Context, db bun.IDB) error {
+	if db.Dialect().Name() != dialect.MySQL {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE status DROP INDEX status_text_fulltext_idx")
+	return err
+}
@@ -0,0 +1,354 @@
+package activitypublog
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"html"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Misskeyのユーザー
+type mUser struct {
+	Id         string
+	Username   string
+	Host       string
+	Name       string
+	AvatarUrl  string `json:"avatarUrl"`
+	NotesCount int    `json:"notesCount"`
+}
+
+// Misskeyのドライブのファイル。typeはMIMEタイプ
+type mDriveFile struct {
+	Id           string
+	Type         string
+	Url          string
+	ThumbnailUrl string `json:"thumbnailUrl"`
+	Comment      string
+	Blurhash     string
+	IsSensitive  bool `json:"isSensitive"`
+	Properties   struct {
+		Width  int
+		Height int
+	}
+}
+
+// Misskeyのノート。textとcwはnullのことがある
+type mNote struct {
+	Id         string
+	CreatedAt  string `json:"createdAt"`
+	UserId     string `json:"userId"`
+	User       mUser
+	Text       string
+	Cw         *string
+	Visibility string
+	ReplyId    string `json:"replyId"`
+	Reply      *mNote
+	RenoteId   string `json:"renoteId"`
+	Renote     *mNote
+	Files      []mDriveFile
+	Tags       []string
+	Uri        string
+	Url        string
+}
+
+// MiAuthのセッションIDはUUIDにする
+func newMiAuthSession() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// 許可されたセッションのトークンを受け取る
+func hPostMiAuthCheck(ctx context.Context, host string, session string) (string, error) {
+	var r struct {
+		Ok    bool
+		Token string
+	}
+	if _, err := mastodon.PostJSON(ctx, "https://"+host+"/api/miauth/"+url.PathEscape(session)+"/check", map[string]string{}, &r); err != nil {
+		return "", fmt.Errorf("failed to POST miauth/:session/check: %w", err)
+	}
+	if !r.Ok || r.Token == "" {
+		return "", fmt.Errorf("miauth session was not authorized: %s", session)
+	}
+	return r.Token, nil
+}
+
+func hPostMisskeyI(ctx context.Context, host string, token string) (mUser, error) {
+	var user mUser
+	if _, err := mastodon.PostJSON(ctx, "https://"+host+"/api/i", map[string]string{"i": token}, &user); err != nil {
+		return user, fmt.Errorf("failed to POST i: %w", err)
+	}
+	return user, nil
+}
+
+// users/notesを1ページ取得する。sinceIdを指定すると古い順、それ以外は新しい順で返る
+func hPostMisskeyUserNotes(ctx context.Context, host string, token string, userId string, sinceId string, untilId string) ([]Status, error) {
+	var statuses []Status
+	body := map[string]interface{}{
+		"i":           token,
+		"userId":      userId,
+		"limit":       StatusPageLimit(),
+		"withReplies": true,
+		"withRenotes": true,
+		// 2023.10より前のMisskeyの名前
+		"includeReplies":   true,
+		"includeMyRenotes": true,
+	}
+	if sinceId != "" {
+		body["sinceId"] = sinceId
+	}
+	if untilId != "" {
+		body["untilId"] = untilId
+	}
+	var res []mNote
+	if _, err := mastodon.PostJSON(ctx, "https://"+host+"/api/users/notes", body, &res); err != nil {
+		return statuses, fmt.Errorf("failed to POST users/notes: %w", err)
+	}
+	for _, v := range res {
+		s, ok := v.toStatus(host, userId)
+		if !ok {
+			continue
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// Misskeyの公開範囲をMastodonのものに読み替える
+var misskeyVisibilities = map[string]string{
+	"public":    "public",
+	"home":      "unlisted",
+	"followers": "private",
+	"specified": "direct",
+}
+
+// 知らない公開範囲は、公開ページに出てしまわないよう一番狭いdirectとして扱う
+func misskeyVisibility(v string) string {
+	if visibility, ok := misskeyVisibilities[v]; ok {
+		return visibility
+	}
+	return "direct"
+}
+
+func (u mUser) acct() string {
+	if u.Host == "" {
+		return u.Username
+	}
+	return u.Username + "@" + u.Host
+}
+
+func (v mNote) url(host string) string {
+	if v.Url != "" {
+		return v.Url
+	}
+	// 他サーバーのノートはuriが元の場所
+	if v.Uri != "" {
+		return v.Uri
+	}
+	return "https://" + host + "/notes/" + v.Id
+}
+
+// 本文以外がないリノートはブースト。引用リノートは普通の投稿として扱う
+func (v mNote) isPureRenote() bool {
+	return v.Renote != nil && v.Text == "" && v.Cw == nil && len(v.Files) == 0
+}
+
+// MFMはHTMLではないので、エスケープして改行だけ<br>にする
+func mfmToHtml(text string) string {
+	if text == "" {
+		return ""
+	}
+	return "<p>" + strings.ReplaceAll(html.EscapeString(text), "\n", "<br>") + "</p>"
+}
+
+func (v mNote) toStatus(host string, accountId string) (Status, bool) {
+	location, _ := time.LoadLocation("Asia/Tokyo")
+	ca, err := time.Parse(time.RFC3339, v.CreatedAt)
+	if err != nil {
+		return Status{}, false
+	}
+	kind := StatusKindPost
+	var reblogOfId, reblogOfUrl, reblogAuthorAcct, reblogAuthorName string
+	body := v
+	if v.isPureRenote() {
+		kind = StatusKindReblog
+		body = *v.Renote
+		reblogOfId = body.Id
+		reblogOfUrl = httpUrlOrEmpty(body.url(host))
+		reblogAuthorAcct = body.User.acct()
+		reblogAuthorName = body.User.Name
+	}
+	var spoilerText string
+	sensitive := false
+	if body.Cw != nil {
+		spoilerText = *body.Cw
+		sensitive = true
+	}
+	for _, f := range body.Files {
+		sensitive = sensitive || f.IsSensitive
+	}
+	var tags []Tag
+	for _, name := range v.Tags {
+		tags = append(tags, Tag{Name: name})
+	}
+	var inReplyToAccountId string
+	if v.Reply != nil {
+		inReplyToAccountId = v.Reply.UserId
+	}
+	return Status{
+		Id:                 v.Id,
+		Account:            v.User.toAccount(host),
+		Text:               body.Text,
+		Content:            mfmToHtml(body.Text),
+		SpoilerText:        spoilerText,
+		Sensitive:          sensitive,
+		Url:                httpUrlOrEmpty(v.url(host)),
+		CreatedAt:          ca.In(location),
+		Tags:               tags,
+		Host:               host,
+		AccountId:          accountId,
+		Visibility:         misskeyVisibility(v.Visibility),
+		InReplyToId:        v.ReplyId,
+		InReplyToAccountId: inReplyToAccountId,
+		MediaAttachments:   toMisskeyMediaAttachments(host, v.Id, body.Files),
+		Kind:               kind,
+		ReblogOfId:         reblogOfId,
+		ReblogOfUrl:        reblogOfUrl,
+		ReblogAuthorAcct:   reblogAuthorAcct,
+		ReblogAuthorName:   reblogAuthorName,
+	}, true
+}
+
+func (u mUser) toAccount(host string) Account {
+	return Account{
+		Id:            u.Id,
+		Host:          host,
+		Acct:          u.acct(),
+		Avatar:        u.AvatarUrl,
+		DisplayName:   u.Name,
+		Url:           "https://" + host + "/@" + u.acct(),
+		StatusesCount: u.NotesCount,
+		UserName:      u.Username,
+	}
+}
+
+// MIMEタイプをMastodonのメディアの種類にする
+func mediaTypeFromMimeType(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "image"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "video"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	}
+	return "unknown"
+}
+
+func toMisskeyMediaAttachments(host string, statusId string, files []mDriveFile) []MediaAttachment {
+	var media []MediaAttachment
+	for i, f := range files {
+		media = append(media, MediaAttachment{
+			Id:          f.Id,
+			Host:        host,
+			StatusId:    statusId,
+			Position:    i,
+			Type:        mediaTypeFromMimeType(f.Type),
+			Description: f.Comment,
+			Blurhash:    f.Blurhash,
+			RemoteUrl:   f.Url,
+			PreviewUrl:  f.ThumbnailUrl,
+			Width:       f.Properties.Width,
+			Height:      f.Properties.Height,
+		})
+	}
+	return media
+}
+
+type misskeyAdapter struct{}
+
+func (misskeyAdapter) Software() string {
+	return SoftwareMisskey
+}
+
+// MiAuthはアプリの登録がいらないので、ソフトウェアを覚えておくためだけにアプリを保存する
+func (misskeyAdapter) AuthorizeUrl(ctx context.Context, host string, redirectUri string) (string, string, error) {
+	if _, err := store.SelectAppByHost(host); err != nil {
+		if err := store.InsertApp(App{Host: host, Software: SoftwareMisskey}); err != nil {
+			return "", "", err
+		}
+	}
+	session, err := newMiAuthSession()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create miauth session: %v", err)
+	}
+	u := url.URL{Scheme: "https", Host: host, Path: "/miauth/" + session}
+	q := url.Values{"name": {"chao-activitypublog"}, "callback": {redirectUri}, "permission": {"read:account"}}
+	u.RawQuery = q.Encode()
+	return u.String(), session, nil
+}
+
+// コールバックにはsessionが付いてくるので、ログインを始めたときのものと同じか確かめる
+func (misskeyAdapter) ExchangeToken(ctx context.Context, host string, state string, query url.Values, redirectUri string) (string, error) {
+	if state == "" || query.Get("session") != state {
+		return "", fmt.Errorf("miauth session mismatch")
+	}
+	return hPostMiAuthCheck(ctx, host, state)
+}
+
+func (misskeyAdapter) VerifyCredentials(ctx context.Context, host string, token string) (Account, error) {
+	user, err := hPostMisskeyI(ctx, host, token)
+	if err != nil {
+		return Account{}, err
+	}
+	return user.toAccount(host), nil
+}
+
+// sinceIdのページは古い順なので、最後の要素から次のページを続ける
+// minIdがなければ最新のページからuntilIdで古い方へ進む
+func (misskeyAdapter) StatusesNewerThan(ctx context.Context, host string, token string, accountId string, minId string) ([]Status, error) {
+	var statuses []Status
+	seen := map[string]bool{}
+	sinceId, untilId := minId, ""
+	for {
+		page, err := hPostMisskeyUserNotes(ctx, host, token, accountId, sinceId, untilId)
+		if err != nil {
+			return statuses, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		sort.Slice(page, func(i, j int) bool { return compareStatusIds(page[i].Id, page[j].Id) > 0 })
+		for _, s := range page {
+			if seen[s.Id] {
+				continue
+			}
+			seen[s.Id] = true
+			statuses = append(statuses, s)
+		}
+		if minId != "" {
+			sinceId = page[0].Id
+		} else {
+			untilId = page[len(page)-1].Id
+		}
+	}
+	return statuses, nil
+}
+
+// MisskeyにはLinkヘッダーがないので、nextは返さずにmaxIdでたどってもらう
+func (misskeyAdapter) StatusesOlderThan(ctx context.Context, host string, token string, accountId string, maxId string, page string) ([]Status, string, error) {
+	statuses, err := hPostMisskeyUserNotes(ctx, host, token, accountId, "", maxId)
+	if err != nil {
+		return statuses, "", err
+	}
+	sort.Slice(statuses, func(i, j int) bool { return compareStatusIds(statuses[i].Id, statuses[j].Id) > 0 })
+	return statuses, "", nil
+}
@@ -0,0 +1,19 @@
+package activitypublog
+
+import "testing"
+
+func TestMisskeyVisibility(t *testing.T) {
+	tests := map[string]string{
+		"public":    "public",
+		"home":      "unlisted",
+		"followers": "private",
+		"specified": "direct",
+		"":          "direct",
+		"local":     "direct",
+	}
+	for in, want := range tests {
+		if got := misskeyVisibility(in); got != want {
+			t.Errorf("misskeyVisibility(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -7,10 +7,12 @@ import (
 )
 
 type App struct {
-	bun.BaseModel `bun:"table:app"`
-	Host          string `json:"host" bun:",pk"`
-	ClientId      string `json:"client_id"`
-	ClientSecret  string `json:"client_secret"`
+	bun.BaseModel   `bun:"table:app"`
+	Host            string `json:"host" bun:",pk"`
+	ClientId        string `json:"client_id"`
+	ClientSecret    string `json:"client_secret"`
+	Software        string `json:"-"`
+	SoftwareVersion string `json:"-"`
 }
 
 type Account struct {
@@ -21,28 +23,237 @@ type Account struct {
 	Avatar        string `bun:"-"`
 	DisplayName   string `json:"display_name" bun:"-"`
 	Url           string `bun:"-"`
+	StatusesCount int    `json:"statuses_count" bun:"-"`
 	UserName      string
 	AllFetched    bool `bun:",default:true"`
 	Public        bool `bun:",default:false"`
 	ShowUnlisted  bool
 	ShowPrivate   bool
 	ShowDirect    bool
+	ShowReblogs   bool
+	ShowDeleted   bool
 }
 
 type Tag struct {
-	Name string
-	Url  string
+	bun.BaseModel `bun:"table:tag"`
+	Id            int64  `bun:",pk,autoincrement"`
+	Name          string `bun:",unique"`
+	Url           string `bun:"-"`
+}
+
+type StatusTag struct {
+	bun.BaseModel `bun:"table:status_tag"`
+	StatusId      string `bun:",pk"`
+	Host          string `bun:",pk"`
+	TagId         int64  `bun:",pk"`
+}
+
+type TagCount struct {
+	Name  string
+	Count int
+}
+
+const (
+	StatusKindPost   = "post"
+	StatusKindReblog = "reblog"
+)
+
+// 一覧の絞り込み条件
+type StatusFilter struct {
+	// include（既定）, exclude, onlyのいずれか
+	Reblogs string
+	// サーバーで削除された投稿。値はReblogsと同じ
+	Deleted string
 }
 
 type Status struct {
-	bun.BaseModel `bun:"table:status"`
-	Id            string `bun:",pk"`
+	bun.BaseModel      `bun:"table:status"`
+	Id                 string `bun:",pk"`
+	Host               string `bun:",pk"`
+	AccountId          string
+	Account            Account `bun:"-"`
+	Text               string  `bun:"type:VARCHAR(10000)"`
+	Content            string  `bun:"type:TEXT"`
+	SpoilerText        string  `bun:"type:TEXT"`
+	Sensitive          bool
+	Language           string
+	Url                string
+	CreatedAt          time.Time
+	Tags               []Tag `bun:"-"`
+	Visibility         string
+	EditedAt           time.Time `bun:",nullzero"`
+	InReplyToId        string
+	InReplyToAccountId string
+	Kind               string
+	ReblogOfId         string
+	ReblogOfUrl        string `bun:"type:VARCHAR(2048)"`
+	ReblogAuthorAcct   string
+	ReblogAuthorName   string
+	// サーバーで削除されたのを見つけた時刻。削除されていなければゼロ値
+	DeletedAt        time.Time         `bun:",nullzero"`
+	MediaAttachments []MediaAttachment `bun:"-"`
+	// 一覧でスレッドをまとめたとき、この投稿に続く自分の返信の数
+	ThreadSize int `bun:"-"`
+	// リンクの起点。所有者のページなら空、公開ページなら/users/:host/:username
+	BasePath string `bun:"-"`
+}
+
+const (
+	SavedKindFavourite = "favourite"
+	SavedKindBookmark  = "bookmark"
+)
+
+// お気に入りやブックマークした投稿の控え。他人の投稿なのでstatusとは分けて持つ
+type RemoteStatus struct {
+	bun.BaseModel    `bun:"table:remote_status"`
+	Id               string `bun:",pk"`
+	Host             string `bun:",pk"`
+	AuthorId         string
+	AuthorAcct       string
+	AuthorName       string
+	AuthorUrl        string `bun:"type:VARCHAR(2048)"`
+	Text             string `bun:"type:VARCHAR(10000)"`
+	Content          string `bun:"type:TEXT"`
+	SpoilerText      string `bun:"type:TEXT"`
+	Sensitive        bool
+	Language         string
+	Url              string `bun:"type:VARCHAR(2048)"`
+	CreatedAt        time.Time
+	Visibility       string
+	EditedAt         time.Time         `bun:",nullzero"`
+	MediaAttachments []MediaAttachment `bun:"-"`
+}
+
+// アカウントのお気に入り・ブックマーク。Idが大きいほど新しく保存したもの
+type SavedStatus struct {
+	bun.BaseModel `bun:"table:saved_status"`
+	Id            int64 `bun:",pk,autoincrement"`
+	AccountId     string
+	Host          string
+	Kind          string
+	StatusId      string
+	CreatedAt     time.Time
+}
+
+// 同期で見つかった投稿の版。RevisedAtはその版になった時刻（最初の版は投稿日時、以降は編集日時）
+type StatusRevision struct {
+	bun.BaseModel `bun:"table:status_revision"`
+	Id            int64 `bun:",pk,autoincrement"`
+	StatusId      string
+	Host          string
+	RevisedAt     time.Time
+	Text          string `bun:"type:VARCHAR(10000)"`
+	Content       string `bun:"type:TEXT"`
+	SpoilerText   string `bun:"type:TEXT"`
+	Sensitive     bool
+	ObservedAt    time.Time
+}
+
+type MediaAttachment struct {
+	bun.BaseModel    `bun:"table:media_attachment"`
+	Id               string `bun:",pk"`
+	Host             string `bun:",pk"`
+	StatusId         string
+	Position         int
+	Type             string
+	Description      string `bun:"type:TEXT"`
+	Blurhash         string
+	RemoteUrl        string `bun:"type:VARCHAR(2048)"`
+	PreviewUrl       string `bun:"type:VARCHAR(2048)"`
+	Width            int
+	Height           int
+	BlobKey          string
+	ContentType      string
+	DownloadAttempts int
+}
+
+// 投稿の取り込み結果。何件が新規・更新・変更なしだったか
+type IngestResult struct {
+	Inserted  int
+	Updated   int
+	Unchanged int
+	// 新たに編集が見つかった投稿のid
+	Edited []string
+}
+
+func (r IngestResult) Add(o IngestResult) IngestResult {
+	return IngestResult{Inserted: r.Inserted + o.Inserted, Updated: r.Updated + o.Updated, Unchanged: r.Unchanged + o.Unchanged, Edited: append(r.Edited, o.Edited...)}
+}
+
+type Credential struct {
+	bun.BaseModel `bun:"table:credential"`
+	AccountId     string `bun:",pk"`
 	Host          string `bun:",pk"`
+	AccessToken   string
+	UpdatedAt     time.Time
+}
+
+type SyncSchedule struct {
+	bun.BaseModel   `bun:"table:sync_schedule"`
+	AccountId       string `bun:",pk"`
+	Host            string `bun:",pk"`
+	IntervalMinutes int
+	NextRunAt       time.Time
+	LastRunAt       time.Time `bun:",nullzero"`
+	LastError       string    `bun:"type:VARCHAR(1000)"`
+	LastFetched     int64
+}
+
+const (
+	BackfillQueued   = "queued"
+	BackfillRunning  = "running"
+	BackfillPaused   = "paused"
+	BackfillCanceled = "canceled"
+	BackfillDone     = "done"
+	BackfillFailed   = "failed"
+)
+
+const (
+	// 保存済みより古い投稿を取得する
+	BackfillKindFetch = "fetch"
+	// サーバーのタイムラインと突き合わせて削除された投稿を探す
+	BackfillKindReconcile = "reconcile"
+	// ログインせずにActivityPubのoutboxから公開投稿を取り込む
+	BackfillKindOutbox = "outbox"
+)
+
+type BackfillJob struct {
+	bun.BaseModel   `bun:"table:backfill_job"`
+	Id              int64 `bun:",pk,autoincrement"`
+	AccountId       string
+	Host            string
+	Kind            string
+	State           string
+	PagesFetched    int
+	StatusesFetched int64
+	TotalStatuses   int
+	OldestId        string
+	StatusesDeleted int64
+	// outboxの取り込みで次に読むページ
+	NextPageUrl string `bun:"type:VARCHAR(2048)"`
+	LastError   string `bun:"type:VARCHAR(1000)"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	StartedAt   time.Time `bun:",nullzero"`
+	FinishedAt  time.Time `bun:",nullzero"`
+}
+
+// HTTP Signaturesで署名するためのインスタンスアクターの鍵。行は1つだけ
+type InstanceActor struct {
+	bun.BaseModel `bun:"table:instance_actor"`
+	Id            string `bun:",pk"`
+	PrivateKey    string `bun:"type:TEXT"`
+	CreatedAt     time.Time
+}
+
+// APIを使うための個人用アクセストークン。トークン自体は発行したときに一度だけ見せ、ハッシュだけを保存する
+type PersonalAccessToken struct {
+	bun.BaseModel `bun:"table:personal_access_token"`
+	Id            int64 `bun:",pk,autoincrement"`
 	AccountId     string
-	Account       Account `bun:"-"`
-	Text          string  `bun:"type:VARCHAR(10000)"`
-	Url           string
+	Host          string
+	Name          string
+	TokenHash     string `bun:",unique"`
 	CreatedAt     time.Time
-	Tags          []Tag `bun:"-"`
-	Visibility    string
+	LastUsedAt    time.Time `bun:",nullzero"`
 }
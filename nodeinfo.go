@@ -0,0 +1,131 @@
+package activitypublog
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// NodeInfoのスキーマ。新しい版を優先して読む
+var nodeInfoSchemas = []string{
+	"http://nodeinfo.diaspora.software/ns/schema/2.1",
+	"http://nodeinfo.diaspora.software/ns/schema/2.0",
+	"http://nodeinfo.diaspora.software/ns/schema/1.1",
+	"http://nodeinfo.diaspora.software/ns/schema/1.0",
+}
+
+type NodeInfoSoftware struct {
+	Name    string
+	Version string
+}
+
+// /.well-known/nodeinfoからリンクされたNodeInfoを読み、サーバーのソフトウェアを調べる
+func hGetNodeInfo(ctx context.Context, host string) (NodeInfoSoftware, error) {
+	var software NodeInfoSoftware
+	var wellKnown struct {
+		Links []struct {
+			Rel  string
+			Href string
+		}
+	}
+	if _, err := mastodon.GetJSON(ctx, "https://"+host+"/.well-known/nodeinfo", "", &wellKnown); err != nil {
+		return software, fmt.Errorf("failed to GET .well-known/nodeinfo: %w", err)
+	}
+	href := ""
+	for _, schema := range nodeInfoSchemas {
+		for _, link := range wellKnown.Links {
+			if link.Rel == schema && href == "" {
+				href = link.Href
+			}
+		}
+	}
+	if href == "" {
+		return software, fmt.Errorf("no nodeinfo link for the host: %s", host)
+	}
+	var nodeInfo struct {
+		Software NodeInfoSoftware
+	}
+	if _, err := mastodon.GetJSON(ctx, href, "", &nodeInfo); err != nil {
+		return software, fmt.Errorf("failed to GET nodeinfo: %w", err)
+	}
+	software = nodeInfo.Software
+	software.Name = strings.ToLower(software.Name)
+	if software.Name == "" {
+		return software, fmt.Errorf("nodeinfo has no software name: %s", host)
+	}
+	return software, nil
+}
+
+// @user@domainをWebFingerで引き、ActivityPubのactorのURLを返す
+func hGetWebFingerActor(ctx context.Context, user string, domain string) (string, error) {
+	var res struct {
+		Links []struct {
+			Rel  string
+			Type string
+			Href string
+		}
+	}
+	resource := "acct:" + user + "@" + domain
+	webfingerUrl := "https://" + domain + "/.well-known/webfinger?resource=" + url.QueryEscape(resource)
+	if _, err := checkRemoteUrl(webfingerUrl); err != nil {
+		return "", err
+	}
+	if _, err := remote.GetJSON(ctx, webfingerUrl, "", &res); err != nil {
+		return "", fmt.Errorf("failed to GET .well-known/webfinger: %w", err)
+	}
+	for _, link := range res.Links {
+		if link.Rel == "self" && (link.Type == "application/activity+json" || strings.HasPrefix(link.Type, "application/ld+json")) && link.Href != "" {
+			return link.Href, nil
+		}
+	}
+	return "", fmt.Errorf("no actor for the account: %s", resource)
+}
+
+// アカウントが実際にあるサーバーのホストを返す
+// ドメインとサーバーのホストが違うこともあるので、actorのURLのホストを使う
+func hGetWebFingerHost(ctx context.Context, user string, domain string) (string, error) {
+	actorUrl, err := hGetWebFingerActor(ctx, user, domain)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(actorUrl)
+	if err != nil || u.Host == "" {
+		return domain, nil
+	}
+	return u.Host, nil
+}
+
+// @user@host形式の入力をuserとhostに分ける
+func parseHandle(input string) (string, string, bool) {
+	user, domain, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(input), "@"), "@")
+	if !ok || user == "" || domain == "" || strings.ContainsAny(domain, "/@") {
+		return "", "", false
+	}
+	return user, domain, true
+}
+
+// ログインページの入力をホストにする。ホスト名のほか、URLと@user@host形式を受け付ける
+func resolveLoginHost(ctx context.Context, input string) (string, error) {
+	input = strings.TrimSpace(input)
+	// プロフィールのURLにも@が入るので、URLかどうかを先に見る
+	if strings.Contains(input, "://") {
+		u, err := url.Parse(input)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid url: %s", input)
+		}
+		return u.Host, nil
+	}
+	if strings.Contains(input, "@") {
+		user, domain, ok := parseHandle(input)
+		if !ok {
+			return "", fmt.Errorf("invalid account: %s", input)
+		}
+		return hGetWebFingerHost(ctx, user, domain)
+	}
+	host := strings.TrimSuffix(input, "/")
+	if host == "" || strings.ContainsAny(host, "/ ") {
+		return "", fmt.Errorf("invalid host: %s", input)
+	}
+	return host, nil
+}
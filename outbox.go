@@ -0,0 +1,191 @@
+package activitypublog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// outboxから取り込んだアカウントを用意する。idはactorのURLにする
+// 本人が取り込んだとは限らないので公開ページには出さない。公開するときも未収載は出さない
+func prepareOutboxAccount(actor apActor) (Account, error) {
+	host := hostOf(actor.Id)
+	account := Account{Id: actor.Id, Host: host, UserName: actor.PreferredUsername}
+	if existing, err := store.SelectAccountByUserName(actor.PreferredUsername, host); err == nil && existing.Id != actor.Id {
+		return account, fmt.Errorf("%s@%s is already archived by signing in", actor.PreferredUsername, host)
+	}
+	inserted, err := store.InsertAccountIfNotExists(account.Id, account.UserName, host)
+	if err != nil {
+		return account, err
+	}
+	if inserted > 0 {
+		if err := store.UpdateAccountVisibility(account.Id, host, false, false, false, true, false); err != nil {
+			return account, err
+		}
+	}
+	return account, nil
+}
+
+// outboxを新しい方から最後のページまでたどる。NextPageUrlが次に読むページで、再開時はそこから続ける
+// 取り込み直しても投稿は上書きされるだけなので、2回目以降も最初からたどる
+func runOutboxJob(ctx context.Context, job BackfillJob) (string, error) {
+	var actor apActor
+	if err := hGetActivityPub(ctx, job.AccountId, &actor); err != nil {
+		return BackfillFailed, err
+	}
+	// 取り込んでいる間にactorが別のサーバーを指すようになっていても、そちらへは取りに行かない
+	if actor.Id != job.AccountId {
+		return BackfillFailed, fmt.Errorf("actor id changed: %s", actor.Id)
+	}
+	if job.NextPageUrl == "" {
+		var outbox apCollection
+		if err := actor.fetch(ctx, actor.Outbox, &outbox); err != nil {
+			return BackfillFailed, err
+		}
+		job.TotalStatuses = outbox.TotalItems
+		// ページに分かれていないoutboxは、それ自体を1ページとして読む
+		job.NextPageUrl = actor.Outbox
+		if first := outbox.First.id(); first != "" {
+			job.NextPageUrl = first
+		}
+		job.UpdatedAt = time.Now().UTC()
+		if err := store.UpdateBackfillJobProgress(job); err != nil {
+			return BackfillFailed, err
+		}
+	}
+	for {
+		if ctx.Err() != nil {
+			return BackfillRunning, nil
+		}
+		current, err := store.SelectBackfillJob(job.Id)
+		if err != nil {
+			return BackfillFailed, err
+		}
+		if current.State != BackfillRunning {
+			return current.State, nil
+		}
+		var page apCollection
+		if err := actor.fetch(ctx, job.NextPageUrl, &page); err != nil {
+			return BackfillFailed, err
+		}
+		var statuses []Status
+		for _, item := range page.activities() {
+			var activity apActivity
+			if err := activity.load(ctx, actor, item); err != nil {
+				continue
+			}
+			if s, ok := activity.toStatus(actor); ok {
+				statuses = append(statuses, s)
+			}
+		}
+		result, err := ingestStatuses(ctx, statuses, job.AccountId, job.Host, "")
+		if err != nil {
+			return BackfillFailed, err
+		}
+		job.PagesFetched++
+		job.StatusesFetched += int64(result.Inserted)
+		if len(statuses) > 0 {
+			job.OldestId = statuses[len(statuses)-1].Id
+		}
+		next := page.Next.id()
+		if len(page.activities()) == 0 || next == job.NextPageUrl {
+			next = ""
+		}
+		job.NextPageUrl = next
+		job.UpdatedAt = time.Now().UTC()
+		if err := store.UpdateBackfillJobProgress(job); err != nil {
+			return BackfillFailed, err
+		}
+		if next == "" {
+			if err := store.UpdateAccountAllFetched(job.AccountId); err != nil {
+				return BackfillFailed, err
+			}
+			return BackfillDone, nil
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backfillPageInterval):
+		}
+	}
+}
+
+// outboxの要素はアクティビティそのもののことも、URLだけのこともある
+func (a *apActivity) load(ctx context.Context, actor apActor, item apValue) error {
+	if item.isObject() {
+		return json.Unmarshal(item, a)
+	}
+	id := item.id()
+	if id == "" {
+		return fmt.Errorf("empty activity")
+	}
+	return actor.fetch(ctx, id, a)
+}
+
+// cmd/import-outboxから呼ばれる。argsは@user@hostひとつで、前に--publicを付けると公開ページに出す
+// サーバーのワーカーを待たずにこのプロセスで最後まで取り込む
+func ImportOutboxCommand(args []string) error {
+	if err := godotenv.Load(".env"); err != nil {
+		fmt.Println("failed to load env file")
+	}
+	public := len(args) == 2 && args[0] == "--public"
+	if public {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import-outbox [--public] @user@host")
+	}
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	store = s
+	if _, err := store.Migrate(); err != nil {
+		return err
+	}
+	actor, err := hGetActor(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	account, err := prepareOutboxAccount(actor)
+	if err != nil {
+		return err
+	}
+	if public {
+		if err := store.UpdateAccountPublic(account.Id, account.Host, true); err != nil {
+			return err
+		}
+	}
+	latest, ok, err := store.SelectLatestBackfillJob(account.Id, account.Host, BackfillKindOutbox)
+	if err != nil {
+		return err
+	}
+	if ok && latest.Active() {
+		return fmt.Errorf("an import job for %s is already %s", args[0], latest.State)
+	}
+	now := time.Now().UTC()
+	job := BackfillJob{AccountId: account.Id, Host: account.Host, Kind: BackfillKindOutbox, State: BackfillRunning, CreatedAt: now, UpdatedAt: now, StartedAt: now}
+	if err := store.InsertBackfillJob(&job); err != nil {
+		return err
+	}
+	state, err := runOutboxJob(ctx, job)
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+	}
+	if err := store.FinishBackfillJob(job.Id, state, lastError); err != nil {
+		return err
+	}
+	if lastError != "" {
+		return fmt.Errorf("import failed: %s", lastError)
+	}
+	finished, err := store.SelectBackfillJob(job.Id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %s: %d pages, %d new statuses\n", args[0], finished.PagesFetched, finished.StatusesFetched)
+	return nil
+}
@@ -0,0 +1,106 @@
+package activitypublog
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// アカウントに進行中の削除検出ジョブがなければ新しくキューに積む
+func EnqueueReconcile(account Account, host string) error {
+	return enqueueJob(account, host, BackfillKindReconcile)
+}
+
+// サーバーのタイムラインを新しい順にたどり、ページが覆う範囲にあるのにページに含まれない保存済みの投稿を削除済みにする
+// ジョブのOldestIdは次に調べる範囲の上端（これより古いid）で、再開時はそこから続ける
+func runReconcileJob(ctx context.Context, job BackfillJob) (string, error) {
+	credential, err := store.SelectCredential(job.AccountId, job.Host)
+	if err != nil {
+		return BackfillFailed, err
+	}
+	adapter, err := serverAdapter(job.Host)
+	if err != nil {
+		return BackfillFailed, err
+	}
+	stored, err := store.SelectStatusIdsByAccount(job.AccountId, job.Host)
+	if err != nil {
+		return BackfillFailed, err
+	}
+	var ids []string
+	for id, deleted := range stored {
+		if !deleted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return compareStatusIds(ids[i], ids[j]) > 0 })
+	// idsのうち、まだ調べていない範囲の先頭
+	next := 0
+	for next < len(ids) && job.OldestId != "" && compareStatusIds(ids[next], job.OldestId) >= 0 {
+		next++
+	}
+	for {
+		if ctx.Err() != nil {
+			return BackfillRunning, nil
+		}
+		current, err := store.SelectBackfillJob(job.Id)
+		if err != nil {
+			return BackfillFailed, err
+		}
+		if current.State != BackfillRunning {
+			return current.State, nil
+		}
+		statuses, nextPage, err := adapter.StatusesOlderThan(ctx, job.Host, credential.AccessToken, job.AccountId, job.OldestId, job.NextPageUrl)
+		if err != nil {
+			return BackfillFailed, err
+		}
+		if job.OldestId == "" && len(statuses) > 0 {
+			// 最初のページより新しい保存済みの投稿は、ページの取得後に同期されたものかもしれないので調べない
+			for next < len(ids) && compareStatusIds(ids[next], statuses[0].Id) > 0 {
+				next++
+			}
+		}
+		// ページが空ならそれより古い投稿はサーバーに残っていない
+		lower := ""
+		if len(statuses) > 0 {
+			lower = statuses[len(statuses)-1].Id
+		}
+		onServer := make(map[string]bool, len(statuses))
+		for _, s := range statuses {
+			onServer[s.Id] = true
+		}
+		var missing []string
+		for next < len(ids) && (lower == "" || compareStatusIds(ids[next], lower) >= 0) {
+			if !onServer[ids[next]] {
+				missing = append(missing, ids[next])
+			}
+			next++
+		}
+		deleted, err := store.MarkStatusesDeleted(job.AccountId, job.Host, missing, time.Now().UTC())
+		if err != nil {
+			return BackfillFailed, err
+		}
+		job.StatusesDeleted += deleted
+		job.UpdatedAt = time.Now().UTC()
+		if len(statuses) == 0 {
+			if err := store.UpdateBackfillJobProgress(job); err != nil {
+				return BackfillFailed, err
+			}
+			return BackfillDone, nil
+		}
+		// サーバーにある投稿は取り込み直す。誤って削除済みになっていたものもここで戻る
+		if _, err := ingestStatuses(ctx, statuses, job.AccountId, job.Host, credential.AccessToken); err != nil {
+			return BackfillFailed, err
+		}
+		job.PagesFetched++
+		job.StatusesFetched += int64(len(statuses))
+		job.OldestId = lower
+		job.NextPageUrl = nextPage
+		if err := store.UpdateBackfillJobProgress(job); err != nil {
+			return BackfillFailed, err
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backfillPageInterval):
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package activitypublog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 利用者が指定したサーバーに取りに行くURLを確かめる
+// 内部のアドレスにリクエストさせられないよう、httpsの443番で、ホストがIPアドレスでないものだけを許す
+func checkRemoteUrl(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %s", raw)
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return nil, fmt.Errorf("only https urls are allowed: %s", raw)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("urls with credentials are not allowed: %s", raw)
+	}
+	if port := u.Port(); port != "" && port != "443" {
+		return nil, fmt.Errorf("only port 443 is allowed: %s", raw)
+	}
+	if net.ParseIP(u.Hostname()) != nil {
+		return nil, fmt.Errorf("ip address hosts are not allowed: %s", raw)
+	}
+	return u, nil
+}
+
+// uがbaseと同じオリジンにあるか。checkRemoteUrlを通ったURLどうしなのでホストだけ比べればよい
+func checkSameOrigin(base string, raw string) error {
+	b, err := checkRemoteUrl(base)
+	if err != nil {
+		return err
+	}
+	u, err := checkRemoteUrl(raw)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(u.Hostname(), b.Hostname()) {
+		return fmt.Errorf("%s is not on %s", raw, b.Hostname())
+	}
+	return nil
+}
+
+// 画面のリンクに使うURLはhttpとhttpsだけにする。javascript:などは空にする
+func httpUrlOrEmpty(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return raw
+}
+
+// 内部のアドレスへの接続を止めたときのエラー。再試行しても同じなのでMastodonClientは再試行しない
+var errNonPublicAddress = errors.New("connecting to a non-public address is not allowed")
+
+// ループバック、プライベート、リンクローカルなどでない、インターネット上のアドレスか
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		// 0.0.0.0/8とキャリアグレードNATの100.64.0.0/10
+		if ip4[0] == 0 || (ip4[0] == 100 && ip4[1]&0xc0 == 64) {
+			return false
+		}
+		ip = ip4
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// 名前解決した後、接続する直前のアドレスで確かめるので、DNSが内部のアドレスを返しても接続しない
+func dialPublicOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", errNonPublicAddress, host)
+	}
+	return nil
+}
+
+// インターネット上のアドレスにだけ接続するクライアント。リダイレクト先もcheckRemoteUrlで確かめる
+func newRemoteHttpClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: dialPublicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// プロキシを通すと接続先のアドレスを確かめられない
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			_, err := checkRemoteUrl(req.URL.String())
+			return err
+		},
+	}
+}
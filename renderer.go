@@ -1,8 +1,9 @@
 package activitypublog
 
 import (
+	"html/template"
 	"io"
-	"text/template"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -20,11 +21,98 @@ type TopProps struct {
 	Statuses            []Status
 	AllFetched          bool
 	NoMoreNewerStatuses bool
-	Public              bool
+	IngestResult        *IngestResult
+	ArchiveResult       *ArchiveImportResult
+	Query               string
+	Sort                string
+	CollapseThreads     bool
+	Filter              StatusFilter
+	// 空なら自分の投稿、favouritesかbookmarksならそれぞれの一覧
+	Tab           string
+	SavedStatuses []RemoteStatus
+	// ログインしているサーバーのソフトウェア。お気に入り・ブックマークのタブはMastodonのときだけ出す
+	Software     string
+	Public       bool
+	SyncSchedule SyncSchedule
+	BackfillJob  *BackfillJob
+	BackfillETA  time.Duration
+	ReconcileJob *BackfillJob
+	ReconcileETA time.Duration
+	ApiTokens    []PersonalAccessToken
 }
 
 type UsersProps struct {
+	Host        string
+	UserName    string
+	Statuses    []Status
+	ShowReblogs bool
+	ShowDeleted bool
+	Filter      StatusFilter
+}
+
+type TagsProps struct {
+	// 所有者のページなら空、公開ページなら/users/:host/:username
+	BasePath string
+	Title    string
+	Tags     []TagCount
+}
+
+type TagProps struct {
+	BasePath string
+	Title    string
+	Name     string
+	Months   []MonthCount
+	Statuses []Status
+}
+
+type ThreadProps struct {
+	BasePath string
+	Title    string
+	Statuses []Status
+}
+
+// ログインできないサーバーのページ。Softwareが空ならソフトウェアを調べられなかった
+type UnsupportedProps struct {
+	Host     string
+	Software string
+	Version  string
+	Reason   string
+}
+
+type HistoryProps struct {
+	BasePath  string
+	Title     string
+	Status    Status
+	Revisions []RevisionView
+}
+
+// 静的サイトの投稿一覧のページ。ページは古い方から数え、NewerとOlderは隣のページへのリンク
+type SitePageProps struct {
+	Title    string
 	Host     string
 	UserName string
 	Statuses []Status
+	Page     int
+	Newer    string
+	Older    string
+}
+
+type SiteMonthsProps struct {
+	Title  string
+	Months []MonthCount
+}
+
+// NewerとOlderは隣の月。なければ空
+type SiteMonthProps struct {
+	Title    string
+	Month    string
+	Statuses []Status
+	Newer    string
+	Older    string
+}
+
+// 発行したばかりのトークン。この画面でしか表示しない
+type ApiTokenProps struct {
+	Name  string
+	Token string
 }
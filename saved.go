@@ -0,0 +1,80 @@
+package activitypublog
+
+import (
+	"context"
+	"time"
+)
+
+// お気に入り・ブックマークを新しい順にたどり、保存済みのものが出てきたところで止める。見つかったものは古い順に保存する
+func syncSavedStatuses(ctx context.Context, host string, token string, accountId string, kind string) (int, error) {
+	var found []RemoteStatus
+	pageUrl := ""
+	for {
+		statuses, next, err := hGetSavedStatuses(ctx, host, token, kind, pageUrl)
+		if err != nil {
+			return 0, err
+		}
+		ids := make([]string, len(statuses))
+		for i, s := range statuses {
+			ids[i] = s.Id
+		}
+		saved, err := store.SelectSavedStatusIds(accountId, host, kind, ids)
+		if err != nil {
+			return 0, err
+		}
+		reachedSaved := false
+		for _, s := range statuses {
+			if saved[s.Id] {
+				reachedSaved = true
+				break
+			}
+			found = append(found, s)
+		}
+		if reachedSaved || next == "" {
+			break
+		}
+		pageUrl = next
+	}
+	if len(found) == 0 {
+		return 0, nil
+	}
+	if err := store.UpsertRemoteStatuses(found); err != nil {
+		return 0, err
+	}
+	var media []MediaAttachment
+	for _, s := range found {
+		media = append(media, s.MediaAttachments...)
+	}
+	if err := store.UpsertMediaAttachments(media); err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	saved := make([]SavedStatus, 0, len(found))
+	for i := len(found) - 1; i >= 0; i-- {
+		saved = append(saved, SavedStatus{AccountId: accountId, Host: host, Kind: kind, StatusId: found[i].Id, CreatedAt: now})
+	}
+	if err := store.InsertSavedStatuses(saved); err != nil {
+		return 0, err
+	}
+	return len(found), nil
+}
+
+// 表示用にお気に入り・ブックマークした投稿へメディアを紐づける
+func attachRemoteMedia(statuses []RemoteStatus, host string) ([]RemoteStatus, error) {
+	ids := make([]string, len(statuses))
+	for i, s := range statuses {
+		ids[i] = s.Id
+	}
+	attachments, err := store.SelectMediaAttachmentsByStatuses(host, ids)
+	if err != nil {
+		return nil, err
+	}
+	mediaByStatus := map[string][]MediaAttachment{}
+	for _, a := range attachments {
+		mediaByStatus[a.StatusId] = append(mediaByStatus[a.StatusId], a)
+	}
+	for i, s := range statuses {
+		statuses[i].MediaAttachments = mediaByStatus[s.Id]
+	}
+	return statuses, nil
+}
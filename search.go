@@ -0,0 +1,236 @@
+package activitypublog
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+)
+
+const (
+	SearchTermText       = "text"
+	SearchTermTag        = "tag"
+	SearchTermVisibility = "visibility"
+	SearchTermHas        = "has"
+	SearchTermBefore     = "before"
+	SearchTermAfter      = "after"
+)
+
+// ngramのトークンの長さ（MySQLのngram_token_sizeの既定値）。これより短い語はFULLTEXTで引けないのでLIKEにする
+const ngramTokenSize = 2
+
+// 検索語の1つ。Valueはtag:などの演算子を外した値
+type SearchTerm struct {
+	Kind    string
+	Value   string
+	Negated bool
+}
+
+// 検索クエリ。Clausesの各要素はORでつないだ語で、要素どうしはANDになる
+type SearchQuery struct {
+	Clauses [][]SearchTerm
+	// 関連度順に並べる。本文の語がなければ新しい順のまま
+	Relevance bool
+}
+
+var searchVisibilities = map[string]bool{"public": true, "unlisted": true, "private": true, "direct": true}
+
+// 空白区切りで語を切り出す。"..."の中の空白は語に含める。quotedはその語に"があったか
+func splitSearchQuery(s string) ([]string, []bool) {
+	var tokens []string
+	var quoted []bool
+	var b strings.Builder
+	inQuote, wasQuoted, started := false, false, false
+	flush := func() {
+		if started {
+			tokens = append(tokens, b.String())
+			quoted = append(quoted, wasQuoted)
+		}
+		b.Reset()
+		inQuote, wasQuoted, started = false, false, false
+	}
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			wasQuoted, started = true, true
+		case unicode.IsSpace(r) && !inQuote:
+			flush()
+		default:
+			b.WriteRune(r)
+			started = true
+		}
+	}
+	flush()
+	return tokens, quoted
+}
+
+// 検索欄の文字列を解釈する
+// 語はすべて含むものに絞り込み、"..."は空白を含めた語句、-を付けると除外、ORでつなぐとどれかを含むものになる
+// tag:名前, visibility:公開範囲, has:media, before:日付, after:日付も語と同じように書ける。日付はYYYY-MM-DDで日本時間
+func ParseSearchQuery(s string) (SearchQuery, error) {
+	var query SearchQuery
+	tokens, quoted := splitSearchQuery(s)
+	joinNext := false
+	for i, token := range tokens {
+		if token == "OR" && !quoted[i] {
+			joinNext = len(query.Clauses) > 0
+			continue
+		}
+		term, err := parseSearchTerm(token, quoted[i])
+		if err != nil {
+			return SearchQuery{}, err
+		}
+		if term.Value == "" {
+			continue
+		}
+		if joinNext {
+			last := len(query.Clauses) - 1
+			query.Clauses[last] = append(query.Clauses[last], term)
+		} else {
+			query.Clauses = append(query.Clauses, []SearchTerm{term})
+		}
+		joinNext = false
+	}
+	return query, nil
+}
+
+func parseSearchTerm(token string, quoted bool) (SearchTerm, error) {
+	term := SearchTerm{Kind: SearchTermText, Value: token}
+	if strings.HasPrefix(token, "-") && len(token) > 1 {
+		term.Negated = true
+		term.Value = token[1:]
+	}
+	name, value, ok := strings.Cut(term.Value, ":")
+	// "で囲んだ語はtag:などを含んでいても本文の語にする
+	if !ok || quoted {
+		return term, nil
+	}
+	switch name {
+	case SearchTermTag:
+		tag := normalizeTagName(value)
+		if tag == "" {
+			return term, fmt.Errorf("invalid tag: %s", value)
+		}
+		term.Kind, term.Value = name, tag
+	case SearchTermVisibility:
+		if !searchVisibilities[value] {
+			return term, fmt.Errorf("unknown visibility: %s", value)
+		}
+		term.Kind, term.Value = name, value
+	case SearchTermHas:
+		if value != "media" {
+			return term, fmt.Errorf("unknown has: %s", value)
+		}
+		term.Kind, term.Value = name, value
+	case SearchTermBefore, SearchTermAfter:
+		if _, err := time.ParseInLocation("2006-01-02", value, tokyo()); err != nil {
+			return term, fmt.Errorf("invalid date: %s", value)
+		}
+		term.Kind, term.Value = name, value
+	}
+	return term, nil
+}
+
+func (q SearchQuery) IsEmpty() bool {
+	return len(q.Clauses) == 0
+}
+
+// 関連度の計算に使う、除外でない本文の語
+func (q SearchQuery) textValues() []string {
+	var values []string
+	for _, clause := range q.Clauses {
+		for _, term := range clause {
+			if term.Kind == SearchTermText && !term.Negated {
+				values = append(values, term.Value)
+			}
+		}
+	}
+	return values
+}
+
+// LIKEの%と_をそのまま探せるようにする。エスケープ文字はMySQLとSQLiteで同じに書ける!を使う
+func likePattern(s string) string {
+	r := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return "%" + r.Replace(s) + "%"
+}
+
+// FULLTEXTを使える語。BOOLEAN MODEの語句として"で囲むので、語の中の"は落とす
+func fulltextPhrase(s string) (string, bool) {
+	s = strings.ReplaceAll(s, `"`, "")
+	return `"` + s + `"`, len([]rune(strings.TrimSpace(s))) >= ngramTokenSize
+}
+
+// 語をwhereの条件式にする。除外はここでは考えない
+func (t SearchTerm) condition(mysql bool) (string, []interface{}) {
+	switch t.Kind {
+	case SearchTermTag:
+		return "EXISTS (SELECT 1 FROM status_tag INNER JOIN tag ON tag.id = status_tag.tag_id WHERE status_tag.status_id = status.id AND status_tag.host = status.host AND tag.name = ?)", []interface{}{t.Value}
+	case SearchTermVisibility:
+		return "status.visibility = ?", []interface{}{t.Value}
+	case SearchTermHas:
+		return "EXISTS (SELECT 1 FROM media_attachment WHERE media_attachment.status_id = status.id AND media_attachment.host = status.host)", nil
+	case SearchTermBefore, SearchTermAfter:
+		day, _ := time.ParseInLocation("2006-01-02", t.Value, tokyo())
+		if t.Kind == SearchTermBefore {
+			return "status.created_at < ?", []interface{}{day.UTC()}
+		}
+		return "status.created_at >= ?", []interface{}{day.UTC()}
+	}
+	if phrase, ok := fulltextPhrase(t.Value); ok && mysql {
+		return "MATCH (status.text, status.spoiler_text) AGAINST (? IN BOOLEAN MODE)", []interface{}{phrase}
+	}
+	// マイグレーション3より前の投稿はspoiler_textがNULLなので、NOTを付けても結果がNULLにならないよう空文字にする
+	pattern := likePattern(t.Value)
+	return "(status.text LIKE ? ESCAPE '!' OR COALESCE(status.spoiler_text, '') LIKE ? ESCAPE '!')", []interface{}{pattern, pattern}
+}
+
+// 条件をwhereに加える。ORでつないだ語はまとめて括弧に入れ、-の付いた語はNOTにする
+func (q SearchQuery) apply(sq *bun.SelectQuery) *bun.SelectQuery {
+	mysql := sq.Dialect().Name() == dialect.MySQL
+	for _, clause := range q.Clauses {
+		var conditions []string
+		var args []interface{}
+		for _, term := range clause {
+			condition, termArgs := term.condition(mysql)
+			if term.Negated {
+				condition = "NOT (" + condition + ")"
+			}
+			conditions = append(conditions, condition)
+			args = append(args, termArgs...)
+		}
+		sq = sq.Where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+	return sq
+}
+
+// 並び順を決める。関連度順はMySQLならFULLTEXTのスコア、SQLiteでは語が現れる回数で比べる
+func (q SearchQuery) order(sq *bun.SelectQuery) *bun.SelectQuery {
+	values := q.textValues()
+	if !q.Relevance || len(values) == 0 {
+		return sq.Order("status.id DESC")
+	}
+	if sq.Dialect().Name() == dialect.MySQL {
+		var phrases []string
+		for _, v := range values {
+			if phrase, ok := fulltextPhrase(v); ok {
+				phrases = append(phrases, phrase)
+			}
+		}
+		if len(phrases) > 0 {
+			return sq.OrderExpr("MATCH (status.text, status.spoiler_text) AGAINST (? IN BOOLEAN MODE) DESC", strings.Join(phrases, " ")).Order("status.id DESC")
+		}
+	}
+	var exprs []string
+	var args []interface{}
+	for _, v := range values {
+		for _, column := range []string{"status.text", "COALESCE(status.spoiler_text, '')"} {
+			exprs = append(exprs, "(LENGTH("+column+") - LENGTH(REPLACE(LOWER("+column+"), LOWER(?), ''))) / LENGTH(?)")
+			args = append(args, v, v)
+		}
+	}
+	return sq.OrderExpr(strings.Join(exprs, " + ")+" DESC", args...).Order("status.id DESC")
+}
@@ -1,28 +1,24 @@
 package activitypublog
 
 import (
+	"archive/zip"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io"
+	"html/template"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"text/template"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/go-sql-driver/mysql"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/uptrace/bun"
-	"github.com/uptrace/bun/dialect/mysqldialect"
 )
 
-var db *sql.DB
-var bundb *bun.DB
 var ctx = context.Background()
 
 type PostOauthTokenResponse struct {
@@ -40,39 +36,31 @@ func StartServer() {
 		return
 	}
 
-	cfg := mysql.Config{
-		User:      os.Getenv("MYSQL_USER"),
-		Passwd:    os.Getenv("MYSQL_PASSWORD"),
-		Net:       "tcp",
-		Addr:      os.Getenv("MYSQL_HOST") + ":3306",
-		DBName:    os.Getenv("MYSQL_DATABASE"),
-		ParseTime: true,
-	}
-
-	db, err = sql.Open("mysql", cfg.FormatDSN())
+	store, err = OpenStore()
 	if err != nil {
 		log.Fatal(err)
 	}
-	pingErr := db.Ping()
-	if pingErr != nil {
-		log.Fatal(pingErr)
-	}
 	fmt.Println("datebase connection established.")
-	bundb = bun.NewDB(db, mysqldialect.New())
 
-	var errors []error
-	if _, err = bundb.NewCreateTable().Model((*App)(nil)).IfNotExists().Exec(ctx); err != nil {
-		errors = append(errors, err)
+	applied, err := store.Migrate()
+	for _, m := range applied {
+		fmt.Printf("applied migration %d %s\n", m.Version, m.Name)
 	}
-	if _, err = bundb.NewCreateTable().Model((*Account)(nil)).IfNotExists().Exec(ctx); err != nil {
-		errors = append(errors, err)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if _, err = bundb.NewCreateTable().Model((*Status)(nil)).ForeignKey("(`account_id`, `host`) REFERENCES account (`id`, `host`) ON DELETE CASCADE").ForeignKey("(`visibility`) REFERENCES visibility (`visibility`) ON DELETE CASCADE ON UPDATE CASCADE").IfNotExists().Exec(ctx); err != nil {
-		errors = append(errors, err)
+
+	blobs, err = OpenBlobStore()
+	if err != nil {
+		log.Fatal(err)
 	}
-	if 0 < len(errors) {
-		fmt.Printf("failed to initialize db table: %v", errors)
+
+	go StartSyncScheduler(ctx, time.Minute)
+	go StartMediaArchiver(ctx, time.Minute)
+	if StreamingEnabled() {
+		go StartStreaming(ctx, time.Minute)
 	}
+	StartBackfillWorkers(ctx, BackfillWorkers())
 
 	t := &Template{
 		templates: template.Must(template.ParseGlob("public/views/*.html")),
@@ -88,21 +76,108 @@ func StartServer() {
 		if err != nil {
 			return err
 		}
-		account, err := hGetVerifyCredentials(host, token)
+		adapter, err := serverAdapter(host)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		account, err = dSelectAccount(account.Id, host)
+		account, err := adapter.VerifyCredentials(c.Request().Context(), host, token)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		query := c.QueryParam("q")
-		allStatuses, err := dSelectStatusesByAccountAndText(account.Id, query)
+		account, err = store.SelectAccount(account.Id, host)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
+		query := c.QueryParam("q")
+		filter := NewStatusFilter(c.QueryParam("reblogs"), c.QueryParam("deleted"))
+		collapseThreadsParam := c.QueryParam("threads") == "collapse"
+		sortParam := c.QueryParam("sort")
+		// お気に入り・ブックマークのタブでは自分の投稿の代わりにそれらを表示する
+		tab := c.QueryParam("tab")
+		savedKind, isSavedTab := map[string]string{"favourites": SavedKindFavourite, "bookmarks": SavedKindBookmark}[tab]
+		// お気に入り・ブックマークの取り込みはMastodonのみ
+		isSavedTab = isSavedTab && adapter.Software() == SoftwareMastodon
+		var allStatuses []Status
+		var savedStatuses []RemoteStatus
+		if isSavedTab {
+			savedStatuses, err = store.SelectSavedStatuses(account.Id, host, savedKind, query)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+			savedStatuses, err = attachRemoteMedia(savedStatuses, host)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+		} else {
+			tab = ""
+			search, err := ParseSearchQuery(query)
+			if err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			search.Relevance = sortParam == "relevance"
+			allStatuses, err = store.SelectStatusesByAccountAndText(account.Id, search, filter)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+			if collapseThreadsParam {
+				allStatuses = collapseThreads(allStatuses, account.Id)
+			}
+			allStatuses, err = attachMedia(allStatuses)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+		}
 		noMoreNewerStatuses := c.QueryParam("noMoreNewerStatuses") == "true"
-		props := TopProps{Account: account, Statuses: allStatuses, AllFetched: account.AllFetched, NoMoreNewerStatuses: noMoreNewerStatuses, Public: account.Public}
+		var ingestResult *IngestResult
+		if c.QueryParam("inserted") != "" {
+			inserted, _ := strconv.Atoi(c.QueryParam("inserted"))
+			updated, _ := strconv.Atoi(c.QueryParam("updated"))
+			unchanged, _ := strconv.Atoi(c.QueryParam("unchanged"))
+			ingestResult = &IngestResult{Inserted: inserted, Updated: updated, Unchanged: unchanged}
+		}
+		var archiveResult *ArchiveImportResult
+		if c.QueryParam("archiveInserted") != "" {
+			inserted, _ := strconv.Atoi(c.QueryParam("archiveInserted"))
+			skipped, _ := strconv.Atoi(c.QueryParam("archiveSkipped"))
+			media, _ := strconv.Atoi(c.QueryParam("archiveMedia"))
+			archiveResult = &ArchiveImportResult{Inserted: inserted, Skipped: skipped, Media: media}
+		}
+		// 同期スケジュール導入前からログインしているアカウントにも資格情報とスケジュールを用意する
+		if err := store.UpsertCredential(account.Id, host, token); err != nil {
+			return SendAndOutputError(err)
+		}
+		if err := store.InsertSyncScheduleIfNotExists(account.Id, host, DefaultSyncIntervalMinutes()); err != nil {
+			return SendAndOutputError(err)
+		}
+		schedule, err := store.SelectSyncSchedule(account.Id, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		backfillJob, hasBackfillJob, err := store.SelectLatestBackfillJob(account.Id, host, BackfillKindFetch)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		reconcileJob, hasReconcileJob, err := store.SelectLatestBackfillJob(account.Id, host, BackfillKindReconcile)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		storedStatuses, err := store.CountStatusesByAccount(account.Id, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		apiTokens, err := store.SelectPersonalAccessTokens(account.Id, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		props := TopProps{Account: account, Statuses: allStatuses, AllFetched: account.AllFetched, NoMoreNewerStatuses: noMoreNewerStatuses, Public: account.Public, SyncSchedule: schedule, IngestResult: ingestResult, ArchiveResult: archiveResult, Query: query, Sort: sortParam, CollapseThreads: collapseThreadsParam, Filter: filter, Tab: tab, SavedStatuses: savedStatuses, Software: adapter.Software(), ApiTokens: apiTokens}
+		if hasBackfillJob {
+			props.BackfillJob = &backfillJob
+			props.BackfillETA = backfillJob.ETA(storedStatuses).Round(time.Second)
+		}
+		if hasReconcileJob {
+			props.ReconcileJob = &reconcileJob
+			props.ReconcileETA = reconcileJob.ETA(storedStatuses).Round(time.Second)
+		}
 
 		return c.Render(http.StatusOK, "top", props)
 	})
@@ -112,26 +187,31 @@ func StartServer() {
 		if err != nil {
 			return err
 		}
-		account, nil := hGetVerifyCredentials(host, token)
+		account, err := verifyCredentials(c.Request().Context(), host, token)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		newestStatusId, err := dSelectNewestStatusIdByAccount(account.Id)
+		newestStatusId, err := store.SelectNewestStatusIdByAccount(account.Id)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		newStatuses, nil := hGetAccountStatusesAll(host, token, account.Id, newestStatusId, "")
+		adapter, err := serverAdapter(host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		newStatuses, err := adapter.StatusesNewerThan(c.Request().Context(), host, token, account.Id, newestStatusId)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
 		if len(newStatuses) == 0 {
 			return c.Redirect(302, "/?noMoreNewerStatuses=true")
 		}
-		_, err = dInsertStatuses(newStatuses, account.Id, host)
+		result, err := ingestStatuses(c.Request().Context(), newStatuses, account.Id, host, token)
 		if err != nil {
-			fmt.Printf("db insert error: %v", err)
+			return SendAndOutputError(err)
 		}
-		return c.Redirect(302, "/")
+		q := url.Values{"inserted": {strconv.Itoa(result.Inserted)}, "updated": {strconv.Itoa(result.Updated)}, "unchanged": {strconv.Itoa(result.Unchanged)}}
+		return c.Redirect(302, "/?"+q.Encode())
 	})
 	e.POST("/status/cursor/last", func(c echo.Context) error {
 		SendAndOutputError := HandlerError("POST", "/status/cursor/last", c)
@@ -139,76 +219,254 @@ func StartServer() {
 		if err != nil {
 			return err
 		}
-		account, nil := hGetVerifyCredentials(host, token)
+		account, err := verifyCredentials(c.Request().Context(), host, token)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		allFetched, err := dSelectAccountAllFetchedById(account.Id, host)
+		allFetched, err := store.SelectAccountAllFetchedById(account.Id, host)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
 		if allFetched {
 			return c.Redirect(302, "/?allFetched=true")
 		}
-		for {
-			oldestStatusId, err := dSelectOldestStatusIdByAccount(account.Id)
+		if err := store.UpsertCredential(account.Id, host, token); err != nil {
+			return SendAndOutputError(err)
+		}
+		if err := EnqueueBackfill(account, host); err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.Redirect(302, "/")
+	})
+	e.POST("/saved/sync", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/saved/sync", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		tab := c.FormValue("tab")
+		kind := SavedKindFavourite
+		if tab == "bookmarks" {
+			kind = SavedKindBookmark
+		}
+		if _, err := syncSavedStatuses(c.Request().Context(), host, token, account.Id, kind); err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.Redirect(302, "/?tab="+url.QueryEscape(tab))
+	})
+	e.POST("/status/reconcile", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/status/reconcile", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if err := store.UpsertCredential(account.Id, host, token); err != nil {
+			return SendAndOutputError(err)
+		}
+		if err := EnqueueReconcile(account, host); err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.Redirect(302, "/")
+	})
+	backfillControl := func(path string, to string, from ...string) {
+		e.POST(path, func(c echo.Context) error {
+			SendAndOutputError := HandlerError("POST", path, c)
+			token, host, err := RequireLoggedIn(c)
+			if err != nil {
+				return err
+			}
+			id, err := strconv.ParseInt(c.FormValue("id"), 10, 64)
+			if err != nil {
+				return c.String(http.StatusBadRequest, "invalid job id")
+			}
+			account, err := verifyCredentials(c.Request().Context(), host, token)
 			if err != nil {
 				return SendAndOutputError(err)
 			}
-			newStatuses, nil := hGetAccountStatusesOlderThan(host, token, account.Id, oldestStatusId)
+			err = store.TransitionBackfillJob(id, account.Id, host, to, from...)
 			if err != nil {
 				return SendAndOutputError(err)
 			}
-			if len(newStatuses) == 0 {
-				if err := dUpdateAccountAllFetched(account.Id); err != nil {
+			return c.Redirect(302, "/")
+		})
+	}
+	backfillControl("/backfill/pause", BackfillPaused, BackfillQueued, BackfillRunning)
+	backfillControl("/backfill/resume", BackfillQueued, BackfillPaused)
+	backfillControl("/backfill/cancel", BackfillCanceled, BackfillQueued, BackfillRunning, BackfillPaused)
+	// 公開ページに出ている投稿の添付は誰でも、それ以外は所有者かお気に入り・ブックマークした人だけが見られる
+	e.GET("/media/:key", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/media/:key", c)
+		key := c.Param("key")
+		attachments, err := store.SelectMediaAttachmentsByBlobKey(key)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if len(attachments) == 0 {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		public, err := mediaIsPublic(attachments)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !public {
+			accountId, host, ok, err := mediaViewer(c)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+			owned := false
+			if ok {
+				owned, err = mediaIsOwnedBy(attachments, accountId, host)
+				if err != nil {
 					return SendAndOutputError(err)
 				}
-				return c.Redirect(302, "/")
 			}
-			_, err = dInsertStatuses(newStatuses, account.Id, host)
-			if err != nil {
-				fmt.Printf("db insert error: %v", err)
+			if !owned {
+				return c.String(http.StatusNotFound, "not found")
 			}
-			time.Sleep(time.Second * 2)
 		}
+		f, err := blobs.Open(key)
+		if err != nil {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		defer f.Close()
+		// 中身が変わればキーも変わるが、公開をやめることはあるので共有のキャッシュには短い間だけ置く
+		if public {
+			c.Response().Header().Set("Cache-Control", "public, max-age=3600")
+		} else {
+			c.Response().Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		}
+		contentType := attachments[0].ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		return c.Stream(http.StatusOK, contentType, f)
 	})
-	e.File("/login", "static/login.html")
-	e.GET("/logout", func(c echo.Context) error {
-		tokenCookie := &http.Cookie{
-			Name:    "token",
-			Value:   "",
-			Expires: time.Unix(0, 0),
+	e.GET("/actor", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/actor", c)
+		actor, err := instanceActorDocument()
+		if err != nil {
+			return SendAndOutputError(err)
 		}
-		c.SetCookie(tokenCookie)
-		hostCookie := &http.Cookie{
-			Name:    "host",
-			Value:   "",
-			Expires: time.Unix(0, 0),
+		body, err := json.Marshal(actor)
+		if err != nil {
+			return SendAndOutputError(err)
 		}
-		c.SetCookie(hostCookie)
+		return c.Blob(http.StatusOK, activityJsonType, body)
+	})
+	// インスタンスアクターは誰もフォローしないので、届いたアクティビティは受け取るだけにする
+	e.POST("/actor/inbox", func(c echo.Context) error {
+		return c.NoContent(http.StatusAccepted)
+	})
+	e.GET("/actor/outbox", func(c echo.Context) error {
+		body, _ := json.Marshal(map[string]interface{}{"@context": activityStreamsContext, "id": instanceActorUrl() + "/outbox", "type": "OrderedCollection", "totalItems": 0, "orderedItems": []string{}})
+		return c.Blob(http.StatusOK, activityJsonType, body)
+	})
+	e.GET("/.well-known/webfinger", func(c echo.Context) error {
+		base, err := url.Parse(os.Getenv("BASE_URL"))
+		if err != nil || c.QueryParam("resource") != "acct:"+instanceActorUsername+"@"+base.Host {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"subject": c.QueryParam("resource"),
+			"links":   []map[string]string{{"rel": "self", "type": activityJsonType, "href": instanceActorUrl()}},
+		})
+		return c.Blob(http.StatusOK, "application/jrd+json", body)
+	})
+	e.POST("/archive/import", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/archive/import", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		fh, err := c.FormFile("archive")
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		defer f.Close()
+		zr, err := zip.NewReader(f, fh.Size)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "not a zip file: "+err.Error())
+		}
+		result, err := importArchive(c.Request().Context(), zr, account, host, token)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		q := url.Values{"archiveInserted": {strconv.Itoa(result.Inserted)}, "archiveSkipped": {strconv.Itoa(result.Skipped)}, "archiveMedia": {strconv.Itoa(result.Media)}}
+		return c.Redirect(302, "/?"+q.Encode())
+	})
+	e.GET("/archive/export", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/archive/export", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		c.Response().Header().Set(echo.HeaderContentType, "application/zip")
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="archive-%s-%s.zip"`, account.UserName, host))
+		c.Response().WriteHeader(http.StatusOK)
+		// 書き出し始めたあとはステータスを変えられないので、ログに出すだけにする
+		if err := exportArchive(c.Response(), account, host); err != nil {
+			fmt.Printf("error GET /archive/export: %v\n", err)
+		}
+		return nil
+	})
+	e.File("/login", "static/login.html")
+	e.GET("/logout", func(c echo.Context) error {
+		ClearLoginCookies(c)
 		return c.Redirect(302, "/login")
 	})
 	e.POST("/sign_in", func(c echo.Context) error {
 		SendAndOutputError := HandlerError("POST", "/sign_in", c)
-		host := c.FormValue("host")
-		app, err := dSelectAppByHost(host)
+		input := c.FormValue("host")
+		host, err := resolveLoginHost(c.Request().Context(), input)
 		if err != nil {
-			fmt.Println("app data was not found in db. fetch it.")
-			app, err = hPostApp(host, os.Getenv("BASE_URL"))
-			if err != nil {
-				return SendAndOutputError(err)
+			return c.Render(http.StatusBadRequest, "unsupported", UnsupportedProps{Host: input, Reason: err.Error()})
+		}
+		// NodeInfoでソフトウェアを調べる。読めなければ、一度ログインしたホストは覚えているものを、初めてならフォームで選んだものを使う
+		software := c.FormValue("software")
+		version := ""
+		nodeInfo, nodeInfoErr := hGetNodeInfo(c.Request().Context(), host)
+		if nodeInfoErr == nil {
+			software, version = nodeInfo.Name, nodeInfo.Version
+		} else if app, err := store.SelectAppByHost(host); err == nil {
+			software, version = app.Software, app.SoftwareVersion
+		}
+		adapter, err := adapterForSoftware(software)
+		if err != nil {
+			props := UnsupportedProps{Host: host, Software: software, Version: version}
+			if software == "" && nodeInfoErr != nil {
+				props.Reason = nodeInfoErr.Error()
 			}
-			err = dInsertApp(app)
-			if err != nil {
+			return c.Render(http.StatusUnprocessableEntity, "unsupported", props)
+		}
+		authorizeUrl, state, err := adapter.AuthorizeUrl(c.Request().Context(), host, os.Getenv("BASE_URL")+"/authorize")
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if nodeInfoErr == nil {
+			if err := store.UpdateAppSoftware(host, software, version); err != nil {
 				return SendAndOutputError(err)
 			}
 		}
-		u := url.URL{}
-		u.Scheme = "https"
-		u.Host = host
-		u.Path = "/oauth/authorize"
-		q := url.Values{"response_type": {"code"}, "client_id": {app.ClientId}, "redirect_uri": {os.Getenv("BASE_URL") + "/authorize"}}
-		u.RawQuery = q.Encode()
 		cookie := &http.Cookie{
 			Name:    "authentication-ongoing-instance-name",
 			Value:   host,
@@ -216,7 +474,14 @@ func StartServer() {
 			Path:    "/authorize",
 		}
 		c.SetCookie(cookie)
-		return c.Redirect(302, u.String())
+		stateCookie := &http.Cookie{
+			Name:    "authentication-ongoing-state",
+			Value:   state,
+			Expires: time.Now().Add(5 * time.Minute),
+			Path:    "/authorize",
+		}
+		c.SetCookie(stateCookie)
+		return c.Redirect(302, authorizeUrl)
 	})
 	e.GET("/authorize", func(c echo.Context) error {
 		SendAndOutputError := HandlerError("GET", "/authorize", c)
@@ -225,40 +490,35 @@ func StartServer() {
 			return c.Redirect(302, "/")
 		}
 		host := cookie.Value
-		code := c.QueryParam("code")
-		u := url.URL{}
-		u.Scheme = "https"
-		u.Host = host
-		u.Path = "/oauth/token"
-		app, err := dSelectAppByHost(host)
+		state := ""
+		if stateCookie, err := c.Cookie("authentication-ongoing-state"); err == nil {
+			state = stateCookie.Value
+		}
+		adapter, err := serverAdapter(host)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		q := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {app.ClientId}, "client_secret": {app.ClientSecret}, "redirect_uri": {os.Getenv("BASE_URL") + "/authorize"}}
-		resp, err := http.PostForm(u.String(), q)
+		accessToken, err := adapter.ExchangeToken(c.Request().Context(), host, state, c.QueryParams(), os.Getenv("BASE_URL")+"/authorize")
 		if err != nil {
-			return c.String(http.StatusBadRequest, fmt.Sprintf("failed to create app for the host: %v", err))
+			return c.String(http.StatusBadRequest, err.Error())
 		}
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
+		account, err := adapter.VerifyCredentials(c.Request().Context(), host, accessToken)
 		if err != nil {
-			return c.String(http.StatusInternalServerError, fmt.Sprintf("failed to read response from server: %v", err))
-		}
-		var r PostOauthTokenResponse
-		if err := json.Unmarshal(body, &r); err != nil {
-			return c.String(http.StatusInternalServerError, fmt.Sprintf("failed to parse response from server: %v", err))
+			return SendAndOutputError(err)
 		}
-		account, err := hGetVerifyCredentials(host, r.AccessToken)
+		_, err = store.InsertAccountIfNotExists(account.Id, account.UserName, host)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		_, err = dInsertAccountIfNotExists(account.Id, account.UserName, host)
-		if err != nil {
+		if err := store.UpsertCredential(account.Id, host, accessToken); err != nil {
+			return SendAndOutputError(err)
+		}
+		if err := store.InsertSyncScheduleIfNotExists(account.Id, host, DefaultSyncIntervalMinutes()); err != nil {
 			return SendAndOutputError(err)
 		}
 		tokenCookie := &http.Cookie{
 			Name:    "token",
-			Value:   r.AccessToken,
+			Value:   accessToken,
 			Expires: time.Now().Add(24 * 7 * time.Hour),
 		}
 		c.SetCookie(tokenCookie)
@@ -274,22 +534,243 @@ func StartServer() {
 		SendAndOutputError := HandlerError("GET", "/users/:host/:username", c)
 		username := c.Param("username")
 		host := c.Param("host")
-		account, err := dSelectAccountByUserName(username, host)
+		account, err := store.SelectAccountByUserName(username, host)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
 		if !account.Public {
 			return c.String(http.StatusNotFound, "not found")
 		}
-		statuses, err := dSelectStatusesByAccountWithRestriction(username, host)
+		filter := NewStatusFilter(c.QueryParam("reblogs"), c.QueryParam("deleted"))
+		statuses, err := store.SelectStatusesByAccountWithRestriction(username, host, filter)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		statuses, err = attachMedia(statuses)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
+		statuses = withBasePath(statuses, "/users/"+host+"/"+username)
 
-		props := UsersProps{Host: host, UserName: username, Statuses: statuses}
+		props := UsersProps{Host: host, UserName: username, Statuses: statuses, ShowReblogs: account.ShowReblogs, ShowDeleted: account.ShowDeleted, Filter: filter}
 
 		return c.Render(http.StatusOK, "users", props)
 	})
+	for format := range feedContentTypes {
+		format := format
+		e.GET("/users/:host/:username/feed."+format, func(c echo.Context) error {
+			SendAndOutputError := HandlerError("GET", "/users/:host/:username/feed."+format, c)
+			username := c.Param("username")
+			host := c.Param("host")
+			account, err := store.SelectAccountByUserName(username, host)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+			if !account.Public {
+				return c.String(http.StatusNotFound, "not found")
+			}
+			etag, lastModified, err := feedValidator(account, host, format)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+			c.Response().Header().Set("ETag", etag)
+			if !lastModified.IsZero() {
+				c.Response().Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+			}
+			c.Response().Header().Set("Cache-Control", "public, max-age=60")
+			if feedNotModified(c.Request(), etag, lastModified) {
+				return c.NoContent(http.StatusNotModified)
+			}
+			key := host + "/" + username + "/" + format
+			body, ok := cachedFeed(key, etag)
+			if !ok {
+				body, err = renderUserFeed(account, host, format)
+				if err != nil {
+					return SendAndOutputError(err)
+				}
+				storeFeed(key, etag, body)
+			}
+			return c.Blob(http.StatusOK, feedContentTypes[format], body)
+		})
+	}
+	e.GET("/users/:host/:username/tags", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/users/:host/:username/tags", c)
+		username := c.Param("username")
+		host := c.Param("host")
+		account, err := store.SelectAccountByUserName(username, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !account.Public {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		tags, err := store.SelectTagCountsByAccount(account.Id, host, account.PublicVisibilities(), account.PublicFilter(StatusFilter{}))
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		props := TagsProps{BasePath: "/users/" + host + "/" + username, Title: host + "@" + username, Tags: tags}
+		return c.Render(http.StatusOK, "tags", props)
+	})
+	e.GET("/users/:host/:username/tags/:name", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/users/:host/:username/tags/:name", c)
+		username := c.Param("username")
+		host := c.Param("host")
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "invalid tag name")
+		}
+		account, err := store.SelectAccountByUserName(username, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !account.Public {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		statuses, err := store.SelectStatusesByAccountAndTag(account.Id, host, name, account.PublicVisibilities(), account.PublicFilter(StatusFilter{}))
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		statuses, err = attachMedia(statuses)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		statuses = withBasePath(statuses, "/users/"+host+"/"+username)
+		props := TagProps{BasePath: "/users/" + host + "/" + username, Title: host + "@" + username, Name: normalizeTagName(name), Months: countByMonth(statuses), Statuses: statuses}
+		return c.Render(http.StatusOK, "tag", props)
+	})
+	e.GET("/users/:host/:username/statuses/:id/thread", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/users/:host/:username/statuses/:id/thread", c)
+		username := c.Param("username")
+		host := c.Param("host")
+		account, err := store.SelectAccountByUserName(username, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !account.Public {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		thread, ok, err := buildThread(account.Id, host, c.Param("id"), account.PublicVisibilities(), account.PublicFilter(StatusFilter{}))
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !ok {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		thread, err = attachMedia(thread)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		basePath := "/users/" + host + "/" + username
+		props := ThreadProps{BasePath: basePath, Title: host + "@" + username, Statuses: withBasePath(thread, basePath)}
+		return c.Render(http.StatusOK, "thread", props)
+	})
+	e.GET("/statuses/:id/thread", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/statuses/:id/thread", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		thread, ok, err := buildThread(account.Id, host, c.Param("id"), nil, StatusFilter{})
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !ok {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		thread, err = attachMedia(thread)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		props := ThreadProps{Title: account.DisplayName, Statuses: thread}
+		return c.Render(http.StatusOK, "thread", props)
+	})
+	e.GET("/users/:host/:username/statuses/:id/history", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/users/:host/:username/statuses/:id/history", c)
+		username := c.Param("username")
+		host := c.Param("host")
+		account, err := store.SelectAccountByUserName(username, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !account.Public {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		status, revisions, ok, err := loadHistory(account.Id, host, c.Param("id"), account.PublicVisibilities(), account.PublicFilter(StatusFilter{}))
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !ok {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		props := HistoryProps{BasePath: "/users/" + host + "/" + username, Title: host + "@" + username, Status: status, Revisions: revisions}
+		return c.Render(http.StatusOK, "history", props)
+	})
+	e.GET("/statuses/:id/history", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/statuses/:id/history", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		status, revisions, ok, err := loadHistory(account.Id, host, c.Param("id"), nil, StatusFilter{})
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !ok {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		props := HistoryProps{Title: account.DisplayName, Status: status, Revisions: revisions}
+		return c.Render(http.StatusOK, "history", props)
+	})
+	e.GET("/tags", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/tags", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		tags, err := store.SelectTagCountsByAccount(account.Id, host, nil, StatusFilter{})
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		props := TagsProps{Title: account.DisplayName, Tags: tags}
+		return c.Render(http.StatusOK, "tags", props)
+	})
+	e.GET("/tags/:name", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/tags/:name", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "invalid tag name")
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		statuses, err := store.SelectStatusesByAccountAndTag(account.Id, host, name, nil, StatusFilter{})
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		statuses, err = attachMedia(statuses)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		props := TagProps{Title: account.DisplayName, Name: normalizeTagName(name), Months: countByMonth(statuses), Statuses: statuses}
+		return c.Render(http.StatusOK, "tag", props)
+	})
 	e.POST("/status/public", func(c echo.Context) error {
 		SendAndOutputError := HandlerError("POST", "/status/public", c)
 		token, host, err := RequireLoggedIn(c)
@@ -297,11 +778,11 @@ func StartServer() {
 			return err
 		}
 		public := c.FormValue("public") == "true"
-		account, nil := hGetVerifyCredentials(host, token)
+		account, err := verifyCredentials(c.Request().Context(), host, token)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		err = dUpdateAccountPublic(account.Id, host, public)
+		err = store.UpdateAccountPublic(account.Id, host, public)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
@@ -316,16 +797,183 @@ func StartServer() {
 		showUnlisted := c.FormValue("unlisted") == "on"
 		showPrivate := c.FormValue("private") == "on"
 		showDirect := c.FormValue("direct") == "on"
-		account, nil := hGetVerifyCredentials(host, token)
+		showReblogs := c.FormValue("reblogs") == "on"
+		showDeleted := c.FormValue("deleted") == "on"
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		err = store.UpdateAccountVisibility(account.Id, host, showUnlisted, showPrivate, showDirect, showReblogs, showDeleted)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.Redirect(302, "/")
+	})
+	e.POST("/account/sync", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/account/sync", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		intervalMinutes, err := strconv.Atoi(c.FormValue("interval"))
+		if err != nil || intervalMinutes <= 0 {
+			return c.String(http.StatusBadRequest, "interval must be a positive number of minutes")
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		err = dUpdateAccountVisibility(account.Id, host, showUnlisted, showPrivate, showDirect)
+		err = store.UpdateSyncScheduleInterval(account.Id, host, intervalMinutes)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
 		return c.Redirect(302, "/")
 	})
+	e.POST("/api_tokens", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/api_tokens", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSpace(c.FormValue("name"))
+		if name == "" {
+			return c.String(http.StatusBadRequest, "name is required")
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		issued, err := issuePersonalAccessToken(account.Id, host, name)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		// トークンはここでしか表示しないので、リダイレクトせずにそのまま見せる
+		return c.Render(http.StatusOK, "api-token", ApiTokenProps{Name: name, Token: issued})
+	})
+	e.POST("/api_tokens/delete", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/api_tokens/delete", c)
+		token, host, err := RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(c.FormValue("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "invalid token id")
+		}
+		account, err := verifyCredentials(c.Request().Context(), host, token)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if err := store.DeletePersonalAccessToken(id, account.Id, host); err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.Redirect(302, "/")
+	})
+
+	api := e.Group("/api/v1", RequirePersonalAccessToken)
+	api.GET("/statuses", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError(c)
+		account := apiAccount(c)
+		limit, err := apiPageLimit(c.QueryParam("limit"))
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, err.Error())
+		}
+		search, err := ParseSearchQuery(c.QueryParam("q"))
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, err.Error())
+		}
+		search.Relevance = c.QueryParam("sort") == "relevance"
+		var maxId string
+		var offset int
+		if cursor := c.QueryParam("cursor"); cursor != "" {
+			if maxId, offset, err = decodeCursor(cursor, search.Relevance); err != nil {
+				return apiError(c, http.StatusBadRequest, err.Error())
+			}
+		}
+		filter := NewStatusFilter(c.QueryParam("reblogs"), c.QueryParam("deleted"))
+		// 次のページがあるかを知るために1件多く読む
+		statuses, err := store.SelectStatusesPage(account.Id, account.Host, search, filter, maxId, offset, limit+1)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		var nextCursor *string
+		if len(statuses) > limit {
+			statuses = statuses[:limit]
+			cursor := encodeCursor(statuses[limit-1].Id, offset+limit, search.Relevance)
+			nextCursor = &cursor
+		}
+		views, err := toApiStatuses(statuses, account.Host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"statuses": views, "next_cursor": nextCursor})
+	})
+	api.GET("/statuses/:id", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError(c)
+		account := apiAccount(c)
+		status, ok, err := store.SelectStatus(c.Param("id"), account.Host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !ok || status.AccountId != account.Id {
+			return apiError(c, http.StatusNotFound, "not found")
+		}
+		views, err := toApiStatuses([]Status{status}, account.Host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.JSON(http.StatusOK, views[0])
+	})
+	api.GET("/account", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, toApiAccount(apiAccount(c)))
+	})
+	api.PATCH("/account", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError(c)
+		account := apiAccount(c)
+		var update ApiAccountUpdate
+		if err := json.NewDecoder(c.Request().Body).Decode(&update); err != nil {
+			return apiError(c, http.StatusBadRequest, "invalid json: "+err.Error())
+		}
+		if update.SyncIntervalMinutes != nil && *update.SyncIntervalMinutes <= 0 {
+			return apiError(c, http.StatusBadRequest, "sync_interval_minutes must be positive")
+		}
+		if err := applyApiAccountUpdate(account, update); err != nil {
+			return SendAndOutputError(err)
+		}
+		updated, err := store.SelectAccount(account.Id, account.Host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.JSON(http.StatusOK, toApiAccount(updated))
+	})
+	api.POST("/sync", func(c echo.Context) error {
+		account := apiAccount(c)
+		credential, err := store.SelectCredential(account.Id, account.Host)
+		if err != nil {
+			return apiError(c, http.StatusConflict, "sign in from the browser once before syncing")
+		}
+		result, err := syncNewerStatuses(c.Request().Context(), account.Host, credential.AccessToken, account.Id)
+		if err != nil {
+			// 保存しているトークンが取り消されていても、APIのトークンは有効なのでログアウトはさせない
+			return apiError(c, http.StatusBadGateway, err.Error())
+		}
+		return c.JSON(http.StatusOK, map[string]int{"inserted": result.Inserted, "updated": result.Updated, "unchanged": result.Unchanged})
+	})
+	api.POST("/backfill", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError(c)
+		account := apiAccount(c)
+		if _, err := store.SelectCredential(account.Id, account.Host); err != nil {
+			return apiError(c, http.StatusConflict, "sign in from the browser once before backfilling")
+		}
+		if err := EnqueueBackfill(account, account.Host); err != nil {
+			return SendAndOutputError(err)
+		}
+		job, _, err := store.SelectLatestBackfillJob(account.Id, account.Host, BackfillKindFetch)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.JSON(http.StatusAccepted, map[string]interface{}{"id": job.Id, "state": job.State, "pages_fetched": job.PagesFetched, "statuses_fetched": job.StatusesFetched})
+	})
 
 	e.Logger.Fatal(e.Start(":1323"))
 }
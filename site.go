@@ -0,0 +1,449 @@
+package activitypublog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+const defaultSitePageSize = 50
+
+// 静的サイトの出力先に置く、前回書き出したファイルの一覧
+const siteManifestName = ".build-site.json"
+
+// 静的サイトの1ページの投稿の数
+func SitePageSize() int {
+	v, err := strconv.Atoi(os.Getenv("SITE_PAGE_SIZE"))
+	if err != nil || v <= 0 {
+		return defaultSitePageSize
+	}
+	return v
+}
+
+// 出力先からの相対パスと、その中身のハッシュ。メディアはハッシュの代わりにblobのキー
+type siteManifest struct {
+	Files map[string]string `json:"files"`
+}
+
+type siteBuildResult struct {
+	Written   int
+	Unchanged int
+	Removed   int
+}
+
+type siteBuilder struct {
+	templates *template.Template
+	title     string
+	files     map[string][]byte
+	media     map[string]bool
+}
+
+func (b *siteBuilder) render(name string, templateName string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := b.templates.ExecuteTemplate(&buf, templateName, data); err != nil {
+		return fmt.Errorf("failed to render %s: %v", name, err)
+	}
+	b.files[name] = buf.Bytes()
+	return nil
+}
+
+// 公開ページと同じ投稿を静的サイトのファイルにする。書き出しはwriteSiteで行う
+func buildSite(account Account, host string, siteUrl string) (*siteBuilder, error) {
+	b := &siteBuilder{
+		templates: template.Must(template.ParseGlob("public/views/*.html")),
+		title:     host + "@" + account.UserName,
+		files:     map[string][]byte{},
+		media:     map[string]bool{},
+	}
+	statuses, err := store.SelectStatusesByAccountWithRestriction(account.UserName, host, NewStatusFilter("", ""))
+	if err != nil {
+		return nil, err
+	}
+	tagged := map[string][]Status{}
+	for start := 0; start < len(statuses); start += archiveChunkSize {
+		end := start + archiveChunkSize
+		if end > len(statuses) {
+			end = len(statuses)
+		}
+		chunk, err := attachMedia(statuses[start:end])
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]string, 0, len(chunk))
+		for _, s := range chunk {
+			ids = append(ids, s.Id)
+			for _, m := range s.MediaAttachments {
+				if m.BlobKey != "" {
+					b.media[m.BlobKey] = true
+				}
+			}
+		}
+		tagNames, err := store.SelectTagNamesByStatuses(host, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range chunk {
+			for _, name := range tagNames[s.Id] {
+				tagged[name] = append(tagged[name], s)
+			}
+		}
+	}
+	css, err := os.ReadFile("assets/main.css")
+	if err != nil {
+		return nil, err
+	}
+	b.files["static/main.css"] = css
+	if err := b.buildPages(account, host, statuses); err != nil {
+		return nil, err
+	}
+	if err := b.buildMonths(statuses); err != nil {
+		return nil, err
+	}
+	if err := b.buildTags(tagged); err != nil {
+		return nil, err
+	}
+	if err := b.buildThreads(statuses, account.Id); err != nil {
+		return nil, err
+	}
+	if err := b.buildHistories(statuses, host); err != nil {
+		return nil, err
+	}
+	feedStatuses, err := loadFeedStatuses(statuses)
+	if err != nil {
+		return nil, err
+	}
+	meta := FeedMeta{Title: b.title, Author: account.UserName, Link: siteUrl + "/", SelfUrl: siteUrl + "/feed.atom"}
+	if b.files["feed.atom"], err = renderAtomFeed(meta, feedStatuses); err != nil {
+		return nil, err
+	}
+	meta.SelfUrl = siteUrl + "/feed.rss"
+	if b.files["feed.rss"], err = renderRssFeed(meta, feedStatuses); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ページは古い方から数えるので、新しい投稿が増えても書き換わるのは最新の数ページだけになる
+// 最新のページはindex.htmlにも置く
+func (b *siteBuilder) buildPages(account Account, host string, statuses []Status) error {
+	size := SitePageSize()
+	pages := (len(statuses) + size - 1) / size
+	if pages == 0 {
+		pages = 1
+	}
+	pageUrl := func(n int) string {
+		if n == pages {
+			return "/"
+		}
+		return fmt.Sprintf("/page/%d/", n)
+	}
+	for n := 1; n <= pages; n++ {
+		start := len(statuses) - n*size
+		if start < 0 {
+			start = 0
+		}
+		props := SitePageProps{Title: b.title, Host: host, UserName: account.UserName, Statuses: statuses[start : len(statuses)-(n-1)*size], Page: n}
+		if n < pages {
+			props.Newer = pageUrl(n + 1)
+		}
+		if n > 1 {
+			props.Older = pageUrl(n - 1)
+		}
+		if err := b.render(fmt.Sprintf("page/%d/index.html", n), "site-page", props); err != nil {
+			return err
+		}
+		if n == pages {
+			b.files["index.html"] = b.files[fmt.Sprintf("page/%d/index.html", n)]
+		}
+	}
+	return nil
+}
+
+func (b *siteBuilder) buildMonths(statuses []Status) error {
+	months := countByMonth(statuses)
+	if err := b.render("months/index.html", "site-months", SiteMonthsProps{Title: b.title, Months: months}); err != nil {
+		return err
+	}
+	byMonth := map[string][]Status{}
+	for _, s := range statuses {
+		month := s.CreatedAt.Format("2006-01")
+		byMonth[month] = append(byMonth[month], s)
+	}
+	for i, m := range months {
+		props := SiteMonthProps{Title: m.Month + " - " + b.title, Month: m.Month, Statuses: byMonth[m.Month]}
+		if i+1 < len(months) {
+			props.Newer = months[i+1].Month
+		}
+		if i > 0 {
+			props.Older = months[i-1].Month
+		}
+		if err := b.render("months/"+m.Month+"/index.html", "site-month", props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *siteBuilder) buildTags(tagged map[string][]Status) error {
+	tags := make([]TagCount, 0, len(tagged))
+	for name, statuses := range tagged {
+		tags = append(tags, TagCount{Name: name, Count: len(statuses)})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Name < tags[j].Name
+	})
+	if err := b.render("tags/index.html", "tags", TagsProps{Title: b.title, Tags: tags}); err != nil {
+		return err
+	}
+	for _, t := range tags {
+		// 名前を確かめるようになる前に保存されたタグは、パスに使えなければページを作らない
+		if normalizeTagName(t.Name) != t.Name {
+			continue
+		}
+		statuses := tagged[t.Name]
+		props := TagProps{Title: b.title, Name: t.Name, Months: countByMonth(statuses), Statuses: statuses}
+		if err := b.render("tags/"+t.Name+"/index.html", "tag", props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 自分への返信にはスレッドへのリンクが付くので、一覧にある投稿だけでスレッドを組み立てる
+// スレッドは根の投稿のページに置き、ほかの投稿のページは根のページへ転送する
+func (b *siteBuilder) buildThreads(statuses []Status, accountId string) error {
+	listed := make(map[string]Status, len(statuses))
+	for _, s := range statuses {
+		listed[s.Id] = s
+	}
+	rootOf := func(s Status) string {
+		root := s
+		for depth := 0; depth < len(statuses); depth++ {
+			parent, ok := listed[root.InReplyToId]
+			if root.InReplyToId == "" || root.InReplyToAccountId != accountId || !ok {
+				break
+			}
+			root = parent
+		}
+		return root.Id
+	}
+	threads := map[string][]Status{}
+	for _, s := range statuses {
+		if s.InReplyToId == "" || s.InReplyToAccountId != accountId {
+			continue
+		}
+		root := rootOf(s)
+		if root != s.Id {
+			if err := b.render("statuses/"+s.Id+"/thread/index.html", "site-redirect", "/statuses/"+root+"/thread/"); err != nil {
+				return err
+			}
+		}
+		threads[root] = append(threads[root], s)
+	}
+	for root, replies := range threads {
+		thread := replies
+		if !containsStatus(replies, root) {
+			thread = append([]Status{listed[root]}, replies...)
+		}
+		sort.SliceStable(thread, func(i, j int) bool { return thread[i].CreatedAt.Before(thread[j].CreatedAt) })
+		if err := b.render("statuses/"+root+"/thread/index.html", "thread", ThreadProps{Title: b.title, Statuses: thread}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 編集された投稿には（編集済み）のリンクが付くので、その投稿の版の一覧も書き出す
+func (b *siteBuilder) buildHistories(statuses []Status, host string) error {
+	for _, s := range statuses {
+		if s.EditedAt.IsZero() {
+			continue
+		}
+		revisions, err := store.SelectStatusRevisions(s.Id, host)
+		if err != nil {
+			return err
+		}
+		props := HistoryProps{Title: b.title, Status: s, Revisions: diffRevisions(revisions)}
+		if err := b.render("statuses/"+s.Id+"/history/index.html", "history", props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsStatus(statuses []Status, id string) bool {
+	for _, s := range statuses {
+		if s.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func fileHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// 出力先の中のパスにする。..などで外に出るものはエラー
+func sitePath(outDir string, name string) (string, error) {
+	p := filepath.Join(outDir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(outDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid site path: %s", name)
+	}
+	return p, nil
+}
+
+// 前回から中身が変わったファイルだけを書き、作られなくなったファイルは消す
+// メディアはキーが中身のハッシュなので、なければコピーするだけでよい
+func writeSite(outDir string, b *siteBuilder) (siteBuildResult, error) {
+	var result siteBuildResult
+	manifestPath := filepath.Join(outDir, siteManifestName)
+	old := siteManifest{Files: map[string]string{}}
+	if body, err := os.ReadFile(manifestPath); err == nil {
+		if err := json.Unmarshal(body, &old); err != nil {
+			return result, fmt.Errorf("failed to read %s: %v", manifestPath, err)
+		}
+	}
+	next := siteManifest{Files: map[string]string{}}
+	for name, body := range b.files {
+		hash := fileHash(body)
+		next.Files[name] = hash
+		p, err := sitePath(outDir, name)
+		if err != nil {
+			return result, err
+		}
+		if _, err := os.Stat(p); err == nil && old.Files[name] == hash {
+			result.Unchanged++
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return result, err
+		}
+		if err := os.WriteFile(p, body, 0o644); err != nil {
+			return result, err
+		}
+		result.Written++
+	}
+	for key := range b.media {
+		name := "media/" + key
+		next.Files[name] = key
+		p, err := sitePath(outDir, name)
+		if err != nil {
+			return result, err
+		}
+		if _, err := os.Stat(p); err == nil {
+			result.Unchanged++
+			continue
+		}
+		if err := copySiteMedia(p, key); err != nil {
+			return result, err
+		}
+		result.Written++
+	}
+	for name := range old.Files {
+		if _, ok := next.Files[name]; ok {
+			continue
+		}
+		p, err := sitePath(outDir, name)
+		if err != nil {
+			return result, err
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+		// 空になったディレクトリも消す。中身が残っていればRemoveは失敗するのでそこで止める
+		for dir := filepath.Dir(p); dir != filepath.Clean(outDir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+		result.Removed++
+	}
+	body, err := json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return result, err
+	}
+	return result, os.WriteFile(manifestPath, body, 0o644)
+}
+
+func copySiteMedia(p string, key string) error {
+	r, err := blobs.Open(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to copy media %s: %v", key, err)
+	}
+	return f.Close()
+}
+
+// cmd/build-siteから呼ばれる。argsは@user@hostと出力先のディレクトリ
+// 同じディレクトリに何度でも実行でき、変わったファイルだけが書き換わる
+func BuildSiteCommand(args []string) error {
+	if err := godotenv.Load(".env"); err != nil {
+		fmt.Println("failed to load env file")
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("usage: build-site @user@host outdir")
+	}
+	siteUrl := os.Getenv("SITE_URL")
+	if siteUrl == "" {
+		return fmt.Errorf("SITE_URL is required for feeds")
+	}
+	user, host, ok := parseHandle(args[0])
+	if !ok {
+		return fmt.Errorf("invalid account: %s", args[0])
+	}
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	store = s
+	blobs, err = OpenBlobStore()
+	if err != nil {
+		return err
+	}
+	account, err := store.SelectAccountByUserName(user, host)
+	if err != nil {
+		return fmt.Errorf("%s is not archived: %v", args[0], err)
+	}
+	if !account.Public {
+		return fmt.Errorf("%s is not public", args[0])
+	}
+	b, err := buildSite(account, host, siteUrl)
+	if err != nil {
+		return err
+	}
+	result, err := writeSite(args[1], b)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("built %s into %s: %d written, %d unchanged, %d removed\n", args[0], args[1], result.Written, result.Unchanged, result.Removed)
+	return nil
+}
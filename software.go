@@ -0,0 +1,117 @@
+package activitypublog
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+const (
+	SoftwareMastodon = "mastodon"
+	SoftwareMisskey  = "misskey"
+)
+
+// サーバーのソフトウェアごとのAPIの違いを吸収する
+// 投稿はどのソフトウェアでもStatusにして返し、保存は共通の処理で行う
+type ServerAdapter interface {
+	Software() string
+	// ログインのためにリダイレクトするURLを返す。stateはコールバックまで覚えておき、ExchangeTokenに渡す
+	AuthorizeUrl(ctx context.Context, host string, redirectUri string) (authorizeUrl string, state string, err error)
+	// コールバックのクエリからアクセストークンを得る
+	ExchangeToken(ctx context.Context, host string, state string, query url.Values, redirectUri string) (string, error)
+	VerifyCredentials(ctx context.Context, host string, token string) (Account, error)
+	// minIdより新しい投稿をすべて取得する。minIdが空ならすべての投稿
+	StatusesNewerThan(ctx context.Context, host string, token string, accountId string, minId string) ([]Status, error)
+	// maxIdより古い投稿を1ページ分、新しい順に取得する。maxIdが空なら最新のページ
+	// pageは前の呼び出しが返したnextで、あればmaxIdの代わりにそれを読む。nextが空なら、次はページの最後の投稿のidをmaxIdにする
+	StatusesOlderThan(ctx context.Context, host string, token string, accountId string, maxId string, page string) (statuses []Status, next string, err error)
+}
+
+// NodeInfoのソフトウェア名ごとに、どのAPIで話せるか。フォークは元のソフトウェアと同じAPIを使う
+var softwareFamilies = map[string]string{
+	"mastodon":   SoftwareMastodon,
+	"hometown":   SoftwareMastodon,
+	"misskey":    SoftwareMisskey,
+	"sharkey":    SoftwareMisskey,
+	"firefish":   SoftwareMisskey,
+	"calckey":    SoftwareMisskey,
+	"foundkey":   SoftwareMisskey,
+	"cherrypick": SoftwareMisskey,
+}
+
+func adapterForSoftware(software string) (ServerAdapter, error) {
+	switch softwareFamilies[software] {
+	case SoftwareMastodon:
+		return mastodonAdapter{}, nil
+	case SoftwareMisskey:
+		return misskeyAdapter{}, nil
+	}
+	return nil, fmt.Errorf("unsupported server software: %s", software)
+}
+
+// ログイン時に登録したアプリからホストのソフトウェアを調べる
+func serverAdapter(host string) (ServerAdapter, error) {
+	app, err := store.SelectAppByHost(host)
+	if err != nil {
+		return nil, err
+	}
+	return adapterForSoftware(app.Software)
+}
+
+func verifyCredentials(ctx context.Context, host string, token string) (Account, error) {
+	adapter, err := serverAdapter(host)
+	if err != nil {
+		return Account{}, err
+	}
+	return adapter.VerifyCredentials(ctx, host, token)
+}
+
+type mastodonAdapter struct{}
+
+func (mastodonAdapter) Software() string {
+	return SoftwareMastodon
+}
+
+// アプリが未登録ならここで登録する
+func (mastodonAdapter) AuthorizeUrl(ctx context.Context, host string, redirectUri string) (string, string, error) {
+	app, err := store.SelectAppByHost(host)
+	if err != nil {
+		fmt.Println("app data was not found in db. fetch it.")
+		app, err = hPostApp(ctx, host, redirectUri)
+		if err != nil {
+			return "", "", err
+		}
+		app.Software = SoftwareMastodon
+		if err := store.InsertApp(app); err != nil {
+			return "", "", err
+		}
+	}
+	u := url.URL{Scheme: "https", Host: host, Path: "/oauth/authorize"}
+	q := url.Values{"response_type": {"code"}, "client_id": {app.ClientId}, "redirect_uri": {redirectUri}}
+	u.RawQuery = q.Encode()
+	return u.String(), "", nil
+}
+
+func (mastodonAdapter) ExchangeToken(ctx context.Context, host string, state string, query url.Values, redirectUri string) (string, error) {
+	app, err := store.SelectAppByHost(host)
+	if err != nil {
+		return "", err
+	}
+	r, err := hPostOauthToken(ctx, host, app, query.Get("code"), redirectUri)
+	if err != nil {
+		return "", err
+	}
+	return r.AccessToken, nil
+}
+
+func (mastodonAdapter) VerifyCredentials(ctx context.Context, host string, token string) (Account, error) {
+	return hGetVerifyCredentials(ctx, host, token)
+}
+
+func (mastodonAdapter) StatusesNewerThan(ctx context.Context, host string, token string, accountId string, minId string) ([]Status, error) {
+	return hGetAccountStatusesNewerThan(ctx, host, token, accountId, minId)
+}
+
+func (mastodonAdapter) StatusesOlderThan(ctx context.Context, host string, token string, accountId string, maxId string, page string) ([]Status, string, error) {
+	return hGetAccountStatusesOlderThan(ctx, host, token, accountId, maxId, page)
+}
@@ -0,0 +1,257 @@
+package activitypublog
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/net/html"
+)
+
+// 再取り込み時に上書きしてよい列。主キーや作成日時は変わらない
+var statusMutableColumns = []string{"text", "content", "spoiler_text", "sensitive", "language", "url", "visibility", "edited_at", "kind", "reblog_of_id", "reblog_of_url", "reblog_author_acct", "reblog_author_name", "deleted_at"}
+
+// DBによって時刻の精度が秒までしか残らないので、秒単位で比べる
+func statusChanged(old Status, new Status) bool {
+	return old.Text != new.Text ||
+		old.Content != new.Content ||
+		old.SpoilerText != new.SpoilerText ||
+		old.Sensitive != new.Sensitive ||
+		old.Language != new.Language ||
+		old.Url != new.Url ||
+		old.Visibility != new.Visibility ||
+		old.Kind != new.Kind ||
+		old.ReblogOfUrl != new.ReblogOfUrl ||
+		old.DeletedAt.IsZero() != new.DeletedAt.IsZero() ||
+		editedAtChanged(old, new)
+}
+
+func editedAtChanged(old Status, new Status) bool {
+	return !old.EditedAt.Truncate(time.Second).Equal(new.EditedAt.Truncate(time.Second))
+}
+
+// 投稿の今の内容を版として控える
+func newStatusRevision(s Status, observedAt time.Time) StatusRevision {
+	revisedAt := s.CreatedAt
+	if !s.EditedAt.IsZero() {
+		revisedAt = s.EditedAt
+	}
+	return StatusRevision{
+		StatusId:    s.Id,
+		Host:        s.Host,
+		RevisedAt:   revisedAt.UTC(),
+		Text:        s.Text,
+		Content:     s.Content,
+		SpoilerText: s.SpoilerText,
+		Sensitive:   s.Sensitive,
+		ObservedAt:  observedAt,
+	}
+}
+
+// MastodonのcontentのHTMLから本文のテキストだけを取り出す
+// 段落の区切りは空行、<br>は改行にする。タグや属性は捨てるので、結果をそのまま表示しても安全
+func htmlToText(content string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return strings.TrimSpace(b.String())
+		case html.TextToken:
+			b.Write(z.Text())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "br":
+				b.WriteString("\n")
+			case "p":
+				if b.Len() > 0 {
+					b.WriteString("\n\n")
+				}
+			}
+		}
+	}
+}
+
+// 取得した投稿を保存する。投稿に付随するメディアなどもここでまとめて保存する
+func ingestStatuses(ctx context.Context, statuses []Status, accountId string, host string, token string) (IngestResult, error) {
+	result, err := store.UpsertStatuses(statuses, accountId, host)
+	if err != nil {
+		return result, err
+	}
+	var media []MediaAttachment
+	for _, s := range statuses {
+		media = append(media, s.MediaAttachments...)
+	}
+	if err := store.UpsertMediaAttachments(media); err != nil {
+		return result, err
+	}
+	tagsByStatus := make(map[string][]string, len(statuses))
+	for _, s := range statuses {
+		tagsByStatus[s.Id] = statusTagNames(s)
+	}
+	if err := store.ReplaceStatusTags(host, tagsByStatus); err != nil {
+		return result, err
+	}
+	// 同期の合間に複数回編集されていることもあるので、編集された投稿は履歴を取り直す
+	// 履歴が取れなくても今の版は保存できているので、取り込み自体は失敗にしない
+	for _, id := range result.Edited {
+		revisions, err := hGetStatusHistory(ctx, host, token, id)
+		if err != nil {
+			fmt.Printf("status history: %s@%s: %v\n", id, host, err)
+			continue
+		}
+		if err := store.InsertStatusRevisions(revisions); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// タグの名前に使える文字。本文から拾うときと同じく、文字・数字・_だけにする
+var tagNamePattern = regexp.MustCompile(`^[\p{L}\p{N}_]+$`)
+
+// Mastodonのハッシュタグは大文字小文字を区別しない
+// 名前はURLや静的サイトのパスにも入るので、/や.などを含むものはタグとして扱わず空にする
+func normalizeTagName(name string) string {
+	name = strings.ToLower(strings.TrimPrefix(name, "#"))
+	if !tagNamePattern.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+// 本文中の#から始まる語。前が英数字や/のもの（URLの#など）は除く
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_/&])#([\p{L}\p{N}_]*[\p{L}_][\p{L}\p{N}_]*)`)
+
+func extractHashtags(text string) []string {
+	var names []string
+	for _, m := range hashtagPattern.FindAllStringSubmatch(text, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// APIが返したタグを優先し、なければ本文から拾う。重複は除く
+// ブーストは他人の投稿なので自分のタグには数えない
+func statusTagNames(s Status) []string {
+	if s.Kind == StatusKindReblog {
+		return []string{}
+	}
+	var raw []string
+	for _, t := range s.Tags {
+		raw = append(raw, t.Name)
+	}
+	if len(raw) == 0 {
+		raw = extractHashtags(s.Text)
+	}
+	seen := map[string]bool{}
+	names := []string{}
+	for _, r := range raw {
+		name := normalizeTagName(r)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// 公開ページで見せてよい公開範囲
+func (a Account) PublicVisibilities() []string {
+	visibilities := []string{"public"}
+	if a.ShowUnlisted {
+		visibilities = append(visibilities, "unlisted")
+	}
+	if a.ShowPrivate {
+		visibilities = append(visibilities, "private")
+	}
+	if a.ShowDirect {
+		visibilities = append(visibilities, "direct")
+	}
+	return visibilities
+}
+
+// 公開ページの絞り込み。所有者が見せないことにした投稿はfilterの指定によらず除く
+func (a Account) PublicFilter(filter StatusFilter) StatusFilter {
+	if !a.ShowReblogs {
+		filter.Reblogs = "exclude"
+	}
+	if !a.ShowDeleted {
+		filter.Deleted = "exclude"
+	}
+	return filter
+}
+
+type MonthCount struct {
+	Month string
+	Count int
+}
+
+// 投稿を月ごとに数える。古い月から並ぶ
+func countByMonth(statuses []Status) []MonthCount {
+	counts := map[string]int{}
+	for _, s := range statuses {
+		counts[s.CreatedAt.Format("2006-01")]++
+	}
+	var months []MonthCount
+	for month, count := range counts {
+		months = append(months, MonthCount{Month: month, Count: count})
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Month < months[j].Month })
+	return months
+}
+
+func filterMode(v string) string {
+	switch v {
+	case "exclude", "only":
+		return v
+	default:
+		return "include"
+	}
+}
+
+func NewStatusFilter(reblogs string, deleted string) StatusFilter {
+	return StatusFilter{Reblogs: filterMode(reblogs), Deleted: filterMode(deleted)}
+}
+
+func (f StatusFilter) apply(q *bun.SelectQuery) *bun.SelectQuery {
+	switch f.Reblogs {
+	case "exclude":
+		q = q.Where("status.kind <> ?", StatusKindReblog)
+	case "only":
+		q = q.Where("status.kind = ?", StatusKindReblog)
+	}
+	switch f.Deleted {
+	case "exclude":
+		q = q.Where("status.deleted_at IS NULL")
+	case "only":
+		q = q.Where("status.deleted_at IS NOT NULL")
+	}
+	return q
+}
+
+// applyと同じ条件を読み込んだ投稿で確かめる
+func (f StatusFilter) allows(s Status) bool {
+	reblog := s.Kind == StatusKindReblog
+	deleted := !s.DeletedAt.IsZero()
+	return (f.Reblogs != "exclude" || !reblog) && (f.Reblogs != "only" || reblog) &&
+		(f.Deleted != "exclude" || !deleted) && (f.Deleted != "only" || deleted)
+}
+
+// Mastodonのidは数字の文字列で、古い投稿ほど桁が少ないことがあるので桁数から比べる
+func compareStatusIds(a string, b string) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
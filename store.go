@@ -0,0 +1,105 @@
+package activitypublog
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// app, account, statusなどの永続化を担う。DB_DRIVERでMySQLとSQLiteを切り替える
+type Store interface {
+	Migrate() ([]Migration, error)
+	RollbackMigration() (Migration, bool, error)
+	MigrationStatus() ([]MigrationState, error)
+
+	SelectAppByHost(host string) (App, error)
+	InsertApp(app App) error
+	UpdateAppSoftware(host string, software string, version string) error
+
+	InsertAccountIfNotExists(id string, username string, host string) (int64, error)
+	SelectAccount(accountId string, host string) (Account, error)
+	SelectAccountByUserName(username string, host string) (Account, error)
+	SelectAccountAllFetchedById(accountId string, host string) (bool, error)
+	UpdateAccountAllFetched(accountId string) error
+	UpdateAccountPublic(accountId string, host string, public bool) error
+	UpdateAccountVisibility(accountId string, host string, showUnlisted bool, showPrivate bool, showDirect bool, showReblogs bool, showDeleted bool) error
+
+	UpsertStatuses(statuses []Status, accountId string, host string) (IngestResult, error)
+	SelectNewestStatusIdByAccount(accountId string) (string, error)
+	SelectOldestStatusIdByAccount(accountId string) (string, error)
+	SelectStatusIdsByAccount(accountId string, host string) (map[string]bool, error)
+	MarkStatusesDeleted(accountId string, host string, ids []string, deletedAt time.Time) (int64, error)
+	UpsertRemoteStatuses(statuses []RemoteStatus) error
+	InsertSavedStatuses(saved []SavedStatus) error
+	SelectSavedStatusIds(accountId string, host string, kind string, statusIds []string) (map[string]bool, error)
+	SelectSavedStatuses(accountId string, host string, kind string, includedText string) ([]RemoteStatus, error)
+	InsertStatusRevisions(revisions []StatusRevision) error
+	SelectStatusRevisions(id string, host string) ([]StatusRevision, error)
+	SelectStatusesByAccountAndText(accountId string, search SearchQuery, filter StatusFilter) ([]Status, error)
+	SelectAllStatusesByAccount(accountId string, host string) ([]Status, error)
+	SelectStatusesPage(accountId string, host string, search SearchQuery, filter StatusFilter, maxId string, offset int, limit int) ([]Status, error)
+	SelectStatusesByAccountWithRestriction(username string, host string, filter StatusFilter) ([]Status, error)
+	CountStatusesByAccount(accountId string, host string) (int, error)
+	SelectStatusesLastModified(accountId string, host string) (time.Time, error)
+	SelectStatus(id string, host string) (Status, bool, error)
+	SelectSelfReplies(accountId string, host string, parentIds []string, visibilities []string, filter StatusFilter) ([]Status, error)
+
+	UpsertMediaAttachments(attachments []MediaAttachment) error
+	SelectPendingMediaAttachments(limit int, maxAttempts int) ([]MediaAttachment, error)
+	UpdateMediaAttachmentBlob(attachment MediaAttachment) error
+	SelectMediaAttachmentsByStatuses(host string, statusIds []string) ([]MediaAttachment, error)
+	SelectMediaAttachmentsByBlobKey(key string) ([]MediaAttachment, error)
+
+	ReplaceStatusTags(host string, tagsByStatus map[string][]string) error
+	SelectTagCountsByAccount(accountId string, host string, visibilities []string, filter StatusFilter) ([]TagCount, error)
+	SelectStatusesByAccountAndTag(accountId string, host string, tag string, visibilities []string, filter StatusFilter) ([]Status, error)
+	SelectTagNamesByStatuses(host string, statusIds []string) (map[string][]string, error)
+
+	UpsertCredential(accountId string, host string, token string) error
+	SelectCredential(accountId string, host string) (Credential, error)
+	SelectCredentials() ([]Credential, error)
+
+	InsertSyncScheduleIfNotExists(accountId string, host string, intervalMinutes int) error
+	SelectSyncSchedule(accountId string, host string) (SyncSchedule, error)
+	SelectDueSyncSchedules(now time.Time) ([]SyncSchedule, error)
+	UpdateSyncScheduleResult(schedule SyncSchedule) error
+	UpdateSyncScheduleInterval(accountId string, host string, intervalMinutes int) error
+
+	InsertBackfillJob(job *BackfillJob) error
+	SelectBackfillJob(id int64) (BackfillJob, error)
+	SelectLatestBackfillJob(accountId string, host string, kind string) (BackfillJob, bool, error)
+	ClaimBackfillJob() (BackfillJob, bool, error)
+	UpdateBackfillJobProgress(job BackfillJob) error
+	FinishBackfillJob(id int64, state string, lastError string) error
+	TransitionBackfillJob(id int64, accountId string, host string, to string, from ...string) error
+	RequeueRunningBackfillJobs() error
+
+	InsertPersonalAccessToken(token *PersonalAccessToken) error
+	SelectPersonalAccessTokens(accountId string, host string) ([]PersonalAccessToken, error)
+	SelectPersonalAccessTokenByHash(hash string) (PersonalAccessToken, bool, error)
+	UpdatePersonalAccessTokenLastUsed(id int64, usedAt time.Time) error
+	DeletePersonalAccessToken(id int64, accountId string, host string) error
+
+	SelectInstanceActor() (InstanceActor, bool, error)
+	InsertInstanceActorIfNotExists(actor InstanceActor) error
+
+	Close() error
+}
+
+var store Store
+
+// 環境変数の設定に従ってStoreを開く
+func OpenStore() (Store, error) {
+	switch os.Getenv("DB_DRIVER") {
+	case "", "mysql":
+		return NewMySQLStore(os.Getenv("MYSQL_USER"), os.Getenv("MYSQL_PASSWORD"), os.Getenv("MYSQL_HOST")+":3306", os.Getenv("MYSQL_DATABASE"))
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "activitypublog.db"
+		}
+		return NewSQLiteStore(path)
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER: %s", os.Getenv("DB_DRIVER"))
+	}
+}
@@ -0,0 +1,30 @@
+package activitypublog
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/mysqldialect"
+)
+
+func NewMySQLStore(user string, password string, addr string, dbName string) (Store, error) {
+	cfg := mysql.Config{
+		User:      user,
+		Passwd:    password,
+		Net:       "tcp",
+		Addr:      addr,
+		DBName:    dbName,
+		ParseTime: true,
+	}
+
+	sqldb, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mysql: %v", err)
+	}
+	if err := sqldb.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to mysql: %v", err)
+	}
+	return &bunStore{db: bun.NewDB(sqldb, mysqldialect.New())}, nil
+}
@@ -0,0 +1,24 @@
+package activitypublog
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/sqlitedialect"
+	_ "modernc.org/sqlite"
+)
+
+// 1ファイルのSQLiteで動かす。個人用のアーカイブをMySQLなしで運用するためのもの
+func NewSQLiteStore(path string) (Store, error) {
+	sqldb, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite: %v", err)
+	}
+	// SQLiteは書き込みが1本しか通らないので、コネクションを1つに絞ってSQLITE_BUSYを避ける
+	sqldb.SetMaxOpenConns(1)
+	if err := sqldb.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to sqlite: %v", err)
+	}
+	return &bunStore{db: bun.NewDB(sqldb, sqlitedialect.New())}, nil
+}
@@ -0,0 +1,696 @@
+package activitypublog
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/uptrace/bun"
+)
+
+// Storeの実装がMySQLとSQLiteで同じように振る舞うかを確かめる
+// MySQLはTEST_MYSQL_DSN（例: user:pass@tcp(localhost:3306)/activitypublog_test）があるときだけ。そのDBのテーブルは作り直される
+
+const testHost = "mastodon.example"
+
+type storeCase struct {
+	name string
+	run  func(t *testing.T, s Store)
+}
+
+func openSQLiteTestStore(t *testing.T) Store {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func openMySQLTestStore(t *testing.T) Store {
+	cfg, err := mysql.ParseDSN(os.Getenv("TEST_MYSQL_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewMySQLStore(cfg.User, cfg.Passwd, cfg.Addr, cfg.DBName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 前のケースのテーブルをすべて消してから作り直す
+	for {
+		_, ok, err := s.RollbackMigration()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+	}
+	return s
+}
+
+func TestStore(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) Store
+	}{{"sqlite", openSQLiteTestStore}}
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		backends = append(backends, struct {
+			name string
+			open func(t *testing.T) Store
+		}{"mysql", openMySQLTestStore})
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			for _, c := range storeCases {
+				t.Run(c.name, func(t *testing.T) {
+					s := b.open(t)
+					defer s.Close()
+					if _, err := s.Migrate(); err != nil {
+						t.Fatal(err)
+					}
+					c.run(t, s)
+				})
+			}
+		})
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// DBには秒までしか残らないので、秒で切った時刻を使う
+func testTime(s string) time.Time {
+	v, _ := time.Parse(time.RFC3339, s)
+	return v.UTC()
+}
+
+func testStatus(id string, visibility string) Status {
+	return Status{Id: id, Host: testHost, AccountId: "1", Text: "text " + id, Content: "<p>text " + id + "</p>", Url: "https://" + testHost + "/@alice/" + id, CreatedAt: testTime("2024-01-02T03:04:05Z"), Visibility: visibility}
+}
+
+func statusIds(statuses []Status) []string {
+	ids := []string{}
+	for _, s := range statuses {
+		ids = append(ids, s.Id)
+	}
+	return ids
+}
+
+func wantIds(t *testing.T, statuses []Status, want ...string) {
+	t.Helper()
+	if want == nil {
+		want = []string{}
+	}
+	if got := statusIds(statuses); !reflect.DeepEqual(got, want) {
+		t.Errorf("ids = %v, want %v", got, want)
+	}
+}
+
+// 公開範囲、ブースト、削除済みの組み合わせを入れる
+func seedStatuses(t *testing.T, s Store) {
+	t.Helper()
+	_, err := s.InsertAccountIfNotExists("1", "alice", testHost)
+	must(t, err)
+	reblog := testStatus("105", "public")
+	reblog.Kind = StatusKindReblog
+	reblog.ReblogOfUrl = "https://other.example/@bob/1"
+	reply := testStatus("106", "public")
+	reply.InReplyToId = "101"
+	reply.InReplyToAccountId = "1"
+	deleted := testStatus("107", "public")
+	deleted.InReplyToId = "106"
+	deleted.InReplyToAccountId = "1"
+	statuses := []Status{testStatus("101", "public"), testStatus("102", "unlisted"), testStatus("103", "private"), testStatus("104", "direct"), reblog, reply, deleted}
+	statuses[0].Text = "hello world"
+	statuses[0].EditedAt = testTime("2024-01-04T00:00:00Z")
+	_, err = s.UpsertStatuses(statuses, "1", testHost)
+	must(t, err)
+	_, err = s.MarkStatusesDeleted("1", testHost, []string{"107"}, testTime("2024-02-01T00:00:00Z"))
+	must(t, err)
+}
+
+var storeCases = []storeCase{
+	{"migrations", func(t *testing.T, s Store) {
+		states, err := s.MigrationStatus()
+		must(t, err)
+		if len(states) != len(migrations) {
+			t.Fatalf("len(states) = %d, want %d", len(states), len(migrations))
+		}
+		for _, st := range states {
+			if !st.Applied {
+				t.Errorf("migration %d is not applied", st.Migration.Version)
+			}
+		}
+		m, ok, err := s.RollbackMigration()
+		must(t, err)
+		if !ok || m.Version != migrations[len(migrations)-1].Version {
+			t.Errorf("rolled back %d, %v", m.Version, ok)
+		}
+		states, err = s.MigrationStatus()
+		must(t, err)
+		if states[len(states)-1].Applied {
+			t.Error("last migration is still applied")
+		}
+		done, err := s.Migrate()
+		must(t, err)
+		if len(done) != 1 || done[0].Version != m.Version {
+			t.Errorf("migrated %v, want only %d", done, m.Version)
+		}
+	}},
+	{"schema matches models", func(t *testing.T, s Store) {
+		// モデルに列を足したらマイグレーションも足す
+		db := s.(*bunStore).db
+		models := []interface{}{(*App)(nil), (*Account)(nil), (*Tag)(nil), (*StatusTag)(nil), (*Status)(nil), (*RemoteStatus)(nil), (*SavedStatus)(nil), (*StatusRevision)(nil), (*MediaAttachment)(nil), (*Credential)(nil), (*SyncSchedule)(nil), (*BackfillJob)(nil), (*InstanceActor)(nil), (*PersonalAccessToken)(nil)}
+		for _, model := range models {
+			table := db.Dialect().Tables().Get(reflect.TypeOf(model))
+			for _, field := range table.Fields {
+				exists, err := columnExists(ctx, db, table.Name, field.Name)
+				must(t, err)
+				if !exists {
+					t.Errorf("no migration adds %s.%s", table.Name, field.Name)
+				}
+			}
+		}
+	}},
+	{"migrations rerun", func(t *testing.T, s Store) {
+		// 途中で止まったマイグレーションをやり直せるよう、適用済みの状態からもう一度流しても失敗しない
+		seedStatuses(t, s)
+		db := s.(*bunStore).db
+		for _, m := range migrations {
+			if err := m.Up(ctx, db); err != nil {
+				t.Errorf("migration %d %s: %v", m.Version, m.Name, err)
+			}
+		}
+		revisions, err := s.SelectStatusRevisions("101", testHost)
+		must(t, err)
+		if len(revisions) != 1 {
+			t.Errorf("len(revisions) = %d after rerun", len(revisions))
+		}
+	}},
+	{"migration 5 tags stored statuses", func(t *testing.T, s Store) {
+		// 5より前に保存した投稿の本文から、5の時点の拾い方でタグを埋める
+		for {
+			m, _, err := s.RollbackMigration()
+			must(t, err)
+			if m.Version == 5 {
+				break
+			}
+		}
+		statuses := []status5{{Id: "101", Host: testHost, Text: "#Go と #日本語 と #go"}, {Id: "102", Host: testHost, Text: "https://example.com/#anchor"}}
+		_, err := s.(*bunStore).db.NewInsert().Model(&statuses).Exec(ctx)
+		must(t, err)
+		_, err = s.Migrate()
+		must(t, err)
+		names, err := s.SelectTagNamesByStatuses(testHost, []string{"101", "102"})
+		must(t, err)
+		if !reflect.DeepEqual(names, map[string][]string{"101": {"go", "日本語"}}) {
+			t.Errorf("tags = %v", names)
+		}
+	}},
+	{"app", func(t *testing.T, s Store) {
+		if _, err := s.SelectAppByHost(testHost); err == nil {
+			t.Error("SelectAppByHost before insert: want error")
+		}
+		must(t, s.InsertApp(App{Host: testHost, ClientId: "id", ClientSecret: "secret"}))
+		must(t, s.UpdateAppSoftware(testHost, "mastodon", "4.2.0"))
+		app, err := s.SelectAppByHost(testHost)
+		must(t, err)
+		if app.ClientId != "id" || app.ClientSecret != "secret" || app.Software != "mastodon" || app.SoftwareVersion != "4.2.0" {
+			t.Errorf("app = %+v", app)
+		}
+	}},
+	{"account", func(t *testing.T, s Store) {
+		n, err := s.InsertAccountIfNotExists("1", "alice", testHost)
+		must(t, err)
+		if n != 1 {
+			t.Errorf("first insert affected %d rows", n)
+		}
+		n, err = s.InsertAccountIfNotExists("1", "alice", testHost)
+		must(t, err)
+		if n != 0 {
+			t.Errorf("second insert affected %d rows", n)
+		}
+		fetched, err := s.SelectAccountAllFetchedById("1", testHost)
+		must(t, err)
+		if fetched {
+			t.Error("new account is all fetched")
+		}
+		must(t, s.UpdateAccountAllFetched("1"))
+		must(t, s.UpdateAccountPublic("1", testHost, true))
+		must(t, s.UpdateAccountVisibility("1", testHost, true, false, true, false, true))
+		account, err := s.SelectAccount("1", testHost)
+		must(t, err)
+		want := Account{Id: "1", Host: testHost, UserName: "alice", AllFetched: true, Public: true, ShowUnlisted: true, ShowDirect: true, ShowDeleted: true}
+		if !reflect.DeepEqual(account, want) {
+			t.Errorf("account = %+v, want %+v", account, want)
+		}
+		byName, err := s.SelectAccountByUserName("alice", testHost)
+		must(t, err)
+		if !reflect.DeepEqual(byName, want) {
+			t.Errorf("account by username = %+v, want %+v", byName, want)
+		}
+		if _, err := s.SelectAccount("2", testHost); err == nil {
+			t.Error("SelectAccount for unknown id: want error")
+		}
+	}},
+	{"upsert statuses", func(t *testing.T, s Store) {
+		statuses := []Status{testStatus("101", "public"), testStatus("102", "public")}
+		result, err := s.UpsertStatuses(statuses, "1", testHost)
+		must(t, err)
+		if result.Inserted != 2 || result.Updated != 0 || result.Unchanged != 0 {
+			t.Errorf("first ingest = %+v", result)
+		}
+		statuses = []Status{testStatus("101", "public"), testStatus("102", "public")}
+		statuses[1].Text = "edited"
+		statuses[1].EditedAt = testTime("2024-01-03T00:00:00Z")
+		result, err = s.UpsertStatuses(statuses, "1", testHost)
+		must(t, err)
+		if result.Inserted != 0 || result.Updated != 1 || result.Unchanged != 1 || !reflect.DeepEqual(result.Edited, []string{"102"}) {
+			t.Errorf("second ingest = %+v", result)
+		}
+		status, ok, err := s.SelectStatus("102", testHost)
+		must(t, err)
+		if !ok || status.Text != "edited" || status.Kind != StatusKindPost || !status.EditedAt.Equal(statuses[1].EditedAt) {
+			t.Errorf("status = %+v, %v", status, ok)
+		}
+		if _, ok, err := s.SelectStatus("999", testHost); err != nil || ok {
+			t.Errorf("SelectStatus for unknown id = %v, %v", ok, err)
+		}
+		revisions, err := s.SelectStatusRevisions("102", testHost)
+		must(t, err)
+		if len(revisions) != 2 || revisions[1].Text != "edited" {
+			t.Errorf("revisions = %+v", revisions)
+		}
+		// 同じ版は入れ直しても増えない
+		must(t, s.InsertStatusRevisions(revisions))
+		must(t, s.InsertStatusRevisions([]StatusRevision{{StatusId: "101", Host: testHost, RevisedAt: testTime("2024-01-05T00:00:00Z"), Text: "manual", ObservedAt: testTime("2024-01-05T00:00:00Z")}}))
+		revisions, err = s.SelectStatusRevisions("102", testHost)
+		must(t, err)
+		if len(revisions) != 2 {
+			t.Errorf("len(revisions) = %d after reinsert", len(revisions))
+		}
+		revisions, err = s.SelectStatusRevisions("101", testHost)
+		must(t, err)
+		if len(revisions) != 2 || revisions[1].Text != "manual" {
+			t.Errorf("revisions of 101 = %+v", revisions)
+		}
+	}},
+	{"upsert statuses concurrently", func(t *testing.T, s Store) {
+		// 同じページを同時に取り込んでも重複キーで失敗しない
+		var wg sync.WaitGroup
+		errs := make(chan error, 4)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.UpsertStatuses([]Status{testStatus("101", "public"), testStatus("102", "public"), testStatus("101", "public")}, "1", testHost)
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			must(t, err)
+		}
+		count, err := s.CountStatusesByAccount("1", testHost)
+		must(t, err)
+		if count != 2 {
+			t.Errorf("count = %d", count)
+		}
+	}},
+	{"account statuses", func(t *testing.T, s Store) {
+		seedStatuses(t, s)
+		newest, err := s.SelectNewestStatusIdByAccount("1")
+		must(t, err)
+		oldest, err := s.SelectOldestStatusIdByAccount("1")
+		must(t, err)
+		if newest != "107" || oldest != "101" {
+			t.Errorf("newest, oldest = %s, %s", newest, oldest)
+		}
+		if id, err := s.SelectNewestStatusIdByAccount("2"); err != nil || id != "" {
+			t.Errorf("newest of unknown account = %q, %v", id, err)
+		}
+		count, err := s.CountStatusesByAccount("1", testHost)
+		must(t, err)
+		if count != 7 {
+			t.Errorf("count = %d", count)
+		}
+		all, err := s.SelectAllStatusesByAccount("1", testHost)
+		must(t, err)
+		wantIds(t, all, "107", "106", "105", "104", "103", "102", "101")
+		if all[0].Content == "" || all[0].DeletedAt.IsZero() {
+			t.Errorf("export status = %+v", all[0])
+		}
+		lastModified, err := s.SelectStatusesLastModified("1", testHost)
+		must(t, err)
+		if !lastModified.Equal(testTime("2024-02-01T00:00:00Z")) {
+			t.Errorf("last modified = %v", lastModified)
+		}
+	}},
+	{"mark deleted", func(t *testing.T, s Store) {
+		seedStatuses(t, s)
+		n, err := s.MarkStatusesDeleted("1", testHost, []string{"101", "107"}, testTime("2024-03-01T00:00:00Z"))
+		must(t, err)
+		if n != 1 {
+			t.Errorf("marked %d, want only the one not yet deleted", n)
+		}
+		deleted, err := s.SelectStatusIdsByAccount("1", testHost)
+		must(t, err)
+		if len(deleted) != 7 || !deleted["101"] || !deleted["107"] || deleted["102"] {
+			t.Errorf("deleted = %v", deleted)
+		}
+	}},
+	{"search and page", func(t *testing.T, s Store) {
+		seedStatuses(t, s)
+		query, err := ParseSearchQuery("hello")
+		must(t, err)
+		found, err := s.SelectStatusesByAccountAndText("1", query, StatusFilter{})
+		must(t, err)
+		wantIds(t, found, "101")
+		found, err = s.SelectStatusesByAccountAndText("1", SearchQuery{}, StatusFilter{Reblogs: "only"})
+		must(t, err)
+		wantIds(t, found, "105")
+		page, err := s.SelectStatusesPage("1", testHost, SearchQuery{}, StatusFilter{Deleted: "exclude"}, "106", 0, 2)
+		must(t, err)
+		wantIds(t, page, "105", "104")
+		page, err = s.SelectStatusesPage("1", testHost, SearchQuery{}, StatusFilter{}, "", 5, 10)
+		must(t, err)
+		wantIds(t, page, "102", "101")
+	}},
+	{"search legacy statuses", func(t *testing.T, s Store) {
+		// マイグレーション3より前に保存した投稿はspoiler_textがNULLのまま
+		seedStatuses(t, s)
+		_, err := s.(*bunStore).db.NewUpdate().Table("status").Set("spoiler_text = NULL").Where("id IN (?)", bun.In([]string{"101", "102"})).Exec(ctx)
+		must(t, err)
+		for _, tt := range []struct {
+			query     string
+			relevance bool
+			want      []string
+		}{
+			{"hello", false, []string{"101"}},
+			{"-hello", false, []string{"107", "106", "105", "104", "103", "102"}},
+			{"text -hello", true, []string{"107", "106", "105", "104", "103", "102"}},
+		} {
+			query, err := ParseSearchQuery(tt.query)
+			must(t, err)
+			query.Relevance = tt.relevance
+			found, err := s.SelectStatusesByAccountAndText("1", query, StatusFilter{})
+			must(t, err)
+			wantIds(t, found, tt.want...)
+		}
+	}},
+	{"public statuses", func(t *testing.T, s Store) {
+		seedStatuses(t, s)
+		statuses, err := s.SelectStatusesByAccountWithRestriction("alice", testHost, StatusFilter{})
+		must(t, err)
+		wantIds(t, statuses, "106", "101")
+		must(t, s.UpdateAccountVisibility("1", testHost, true, false, false, true, true))
+		statuses, err = s.SelectStatusesByAccountWithRestriction("alice", testHost, StatusFilter{})
+		must(t, err)
+		wantIds(t, statuses, "107", "106", "105", "102", "101")
+		replies, err := s.SelectSelfReplies("1", testHost, []string{"101", "106"}, []string{"public"}, StatusFilter{})
+		must(t, err)
+		wantIds(t, replies, "106", "107")
+		replies, err = s.SelectSelfReplies("1", testHost, []string{"101", "106"}, []string{"public"}, StatusFilter{Deleted: "exclude"})
+		must(t, err)
+		wantIds(t, replies, "106")
+		replies, err = s.SelectSelfReplies("1", testHost, []string{"101", "106"}, []string{"public"}, Account{}.PublicFilter(StatusFilter{}))
+		must(t, err)
+		wantIds(t, replies, "106")
+		replies, err = s.SelectSelfReplies("1", testHost, []string{"101"}, []string{"unlisted"}, StatusFilter{})
+		must(t, err)
+		wantIds(t, replies)
+	}},
+	{"tags", func(t *testing.T, s Store) {
+		seedStatuses(t, s)
+		must(t, s.ReplaceStatusTags(testHost, map[string][]string{"101": {"cats", "dogs"}, "103": {"cats"}}))
+		must(t, s.ReplaceStatusTags(testHost, map[string][]string{"101": {"cats"}, "107": {"cats"}}))
+		names, err := s.SelectTagNamesByStatuses(testHost, []string{"101", "102", "103"})
+		must(t, err)
+		if !reflect.DeepEqual(names, map[string][]string{"101": {"cats"}, "103": {"cats"}}) {
+			t.Errorf("tag names = %v", names)
+		}
+		counts, err := s.SelectTagCountsByAccount("1", testHost, nil, StatusFilter{})
+		must(t, err)
+		if !reflect.DeepEqual(counts, []TagCount{{Name: "cats", Count: 3}}) {
+			t.Errorf("counts = %v", counts)
+		}
+		counts, err = s.SelectTagCountsByAccount("1", testHost, []string{"public"}, StatusFilter{Deleted: "exclude"})
+		must(t, err)
+		if !reflect.DeepEqual(counts, []TagCount{{Name: "cats", Count: 1}}) {
+			t.Errorf("public counts = %v", counts)
+		}
+		must(t, s.ReplaceStatusTags(testHost, map[string][]string{"105": {"cats"}}))
+		counts, err = s.SelectTagCountsByAccount("1", testHost, []string{"public"}, StatusFilter{Reblogs: "exclude"})
+		must(t, err)
+		if !reflect.DeepEqual(counts, []TagCount{{Name: "cats", Count: 2}}) {
+			t.Errorf("counts without reblogs = %v", counts)
+		}
+		counts, err = s.SelectTagCountsByAccount("1", testHost, []string{"public"}, Account{}.PublicFilter(StatusFilter{}))
+		must(t, err)
+		if !reflect.DeepEqual(counts, []TagCount{{Name: "cats", Count: 1}}) {
+			t.Errorf("public counts with default settings = %v", counts)
+		}
+		statuses, err := s.SelectStatusesByAccountAndTag("1", testHost, "Cats", nil, StatusFilter{})
+		must(t, err)
+		wantIds(t, statuses, "107", "105", "103", "101")
+		if !statuses[3].EditedAt.Equal(testTime("2024-01-04T00:00:00Z")) {
+			t.Errorf("edited_at of a listed status = %v", statuses[3].EditedAt)
+		}
+		statuses, err = s.SelectStatusesByAccountAndTag("1", testHost, "cats", []string{"public"}, Account{ShowReblogs: true}.PublicFilter(StatusFilter{}))
+		must(t, err)
+		wantIds(t, statuses, "105", "101")
+		statuses, err = s.SelectStatusesByAccountAndTag("1", testHost, "cats", []string{"public"}, Account{}.PublicFilter(StatusFilter{}))
+		must(t, err)
+		wantIds(t, statuses, "101")
+	}},
+	{"media", func(t *testing.T, s Store) {
+		attachments := []MediaAttachment{
+			{Id: "m1", Host: testHost, StatusId: "101", Position: 0, Type: "image", RemoteUrl: "https://files.example/1.png"},
+			{Id: "m2", Host: testHost, StatusId: "101", Position: 1, Type: "image", RemoteUrl: "https://files.example/2.png"},
+		}
+		must(t, s.UpsertMediaAttachments(attachments))
+		pending, err := s.SelectPendingMediaAttachments(10, 3)
+		must(t, err)
+		if len(pending) != 2 {
+			t.Fatalf("len(pending) = %d", len(pending))
+		}
+		done := attachments[0]
+		done.BlobKey, done.ContentType, done.DownloadAttempts = "blobkey", "image/png", 1
+		failed := attachments[1]
+		failed.DownloadAttempts = 3
+		must(t, s.UpdateMediaAttachmentBlob(done))
+		must(t, s.UpdateMediaAttachmentBlob(failed))
+		pending, err = s.SelectPendingMediaAttachments(10, 3)
+		must(t, err)
+		if len(pending) != 0 {
+			t.Errorf("pending = %+v", pending)
+		}
+		// メタデータを取り直してもダウンロード済みのblob_keyは残る
+		attachments[0].Description = "a cat"
+		must(t, s.UpsertMediaAttachments(attachments[:1]))
+		byKey, err := s.SelectMediaAttachmentsByBlobKey("blobkey")
+		must(t, err)
+		if len(byKey) != 1 || byKey[0].Id != "m1" || byKey[0].Description != "a cat" || byKey[0].ContentType != "image/png" {
+			t.Errorf("attachments = %+v", byKey)
+		}
+		missing, err := s.SelectMediaAttachmentsByBlobKey("missing")
+		must(t, err)
+		if len(missing) != 0 {
+			t.Errorf("attachments for unknown key = %+v", missing)
+		}
+		byStatus, err := s.SelectMediaAttachmentsByStatuses(testHost, []string{"101"})
+		must(t, err)
+		if len(byStatus) != 2 || byStatus[0].Id != "m1" || byStatus[1].Id != "m2" {
+			t.Errorf("attachments by status = %+v", byStatus)
+		}
+	}},
+	{"saved statuses", func(t *testing.T, s Store) {
+		remote := []RemoteStatus{
+			{Id: "201", Host: testHost, AuthorAcct: "bob@other.example", Text: "first", CreatedAt: testTime("2024-01-01T00:00:00Z"), Visibility: "public"},
+			{Id: "202", Host: testHost, AuthorAcct: "carol@other.example", Text: "second", CreatedAt: testTime("2024-01-02T00:00:00Z"), Visibility: "public"},
+		}
+		must(t, s.UpsertRemoteStatuses(remote))
+		remote[0].Text = "first edited"
+		must(t, s.UpsertRemoteStatuses(remote[:1]))
+		saved := []SavedStatus{
+			{AccountId: "1", Host: testHost, Kind: SavedKindFavourite, StatusId: "201", CreatedAt: testTime("2024-01-03T00:00:00Z")},
+			{AccountId: "1", Host: testHost, Kind: SavedKindFavourite, StatusId: "202", CreatedAt: testTime("2024-01-03T00:00:00Z")},
+		}
+		must(t, s.InsertSavedStatuses(saved))
+		ids, err := s.SelectSavedStatusIds("1", testHost, SavedKindFavourite, []string{"201", "203"})
+		must(t, err)
+		if !reflect.DeepEqual(ids, map[string]bool{"201": true}) {
+			t.Errorf("saved ids = %v", ids)
+		}
+		statuses, err := s.SelectSavedStatuses("1", testHost, SavedKindFavourite, "")
+		must(t, err)
+		if len(statuses) != 2 || statuses[0].Id != "202" || statuses[1].Text != "first edited" {
+			t.Errorf("saved statuses = %+v", statuses)
+		}
+		statuses, err = s.SelectSavedStatuses("1", testHost, SavedKindFavourite, "carol")
+		must(t, err)
+		if len(statuses) != 1 || statuses[0].Id != "202" {
+			t.Errorf("saved statuses by author = %+v", statuses)
+		}
+		statuses, err = s.SelectSavedStatuses("1", testHost, SavedKindBookmark, "")
+		must(t, err)
+		if len(statuses) != 0 {
+			t.Errorf("bookmarks = %+v", statuses)
+		}
+	}},
+	{"credentials", func(t *testing.T, s Store) {
+		must(t, s.UpsertCredential("1", testHost, "old"))
+		must(t, s.UpsertCredential("1", testHost, "new"))
+		must(t, s.UpsertCredential("2", testHost, "other"))
+		credential, err := s.SelectCredential("1", testHost)
+		must(t, err)
+		if credential.AccessToken != "new" {
+			t.Errorf("token = %s", credential.AccessToken)
+		}
+		credentials, err := s.SelectCredentials()
+		must(t, err)
+		if len(credentials) != 2 {
+			t.Errorf("len(credentials) = %d", len(credentials))
+		}
+		if _, err := s.SelectCredential("3", testHost); err == nil {
+			t.Error("SelectCredential for unknown account: want error")
+		}
+	}},
+	{"sync schedule", func(t *testing.T, s Store) {
+		must(t, s.InsertSyncScheduleIfNotExists("1", testHost, 60))
+		must(t, s.InsertSyncScheduleIfNotExists("1", testHost, 10))
+		schedule, err := s.SelectSyncSchedule("1", testHost)
+		must(t, err)
+		if schedule.IntervalMinutes != 60 {
+			t.Errorf("interval = %d, want the first one", schedule.IntervalMinutes)
+		}
+		due, err := s.SelectDueSyncSchedules(time.Now().Add(time.Minute))
+		must(t, err)
+		if len(due) != 1 {
+			t.Errorf("len(due) = %d", len(due))
+		}
+		schedule.NextRunAt = time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		schedule.LastRunAt = testTime("2024-01-01T00:00:00Z")
+		schedule.LastError = "boom"
+		schedule.LastFetched = 5
+		must(t, s.UpdateSyncScheduleResult(schedule))
+		must(t, s.UpdateSyncScheduleInterval("1", testHost, 30))
+		due, err = s.SelectDueSyncSchedules(time.Now().Add(time.Minute))
+		must(t, err)
+		if len(due) != 0 {
+			t.Errorf("due = %+v", due)
+		}
+		got, err := s.SelectSyncSchedule("1", testHost)
+		must(t, err)
+		if got.IntervalMinutes != 30 || got.LastError != "boom" || got.LastFetched != 5 || !got.LastRunAt.Equal(schedule.LastRunAt) {
+			t.Errorf("schedule = %+v", got)
+		}
+	}},
+	{"backfill jobs", func(t *testing.T, s Store) {
+		if _, ok, err := s.SelectLatestBackfillJob("1", testHost, BackfillKindFetch); err != nil || ok {
+			t.Errorf("latest job before insert = %v, %v", ok, err)
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		first := BackfillJob{AccountId: "1", Host: testHost, Kind: BackfillKindFetch, State: BackfillQueued, CreatedAt: now, UpdatedAt: now}
+		second := first
+		must(t, s.InsertBackfillJob(&first))
+		must(t, s.InsertBackfillJob(&second))
+		if first.Id == 0 || second.Id <= first.Id {
+			t.Fatalf("ids = %d, %d", first.Id, second.Id)
+		}
+		latest, ok, err := s.SelectLatestBackfillJob("1", testHost, BackfillKindFetch)
+		must(t, err)
+		if !ok || latest.Id != second.Id {
+			t.Errorf("latest = %d, %v", latest.Id, ok)
+		}
+		claimed, ok, err := s.ClaimBackfillJob()
+		must(t, err)
+		if !ok || claimed.Id != first.Id || claimed.State != BackfillRunning || claimed.StartedAt.IsZero() {
+			t.Errorf("claimed = %+v, %v", claimed, ok)
+		}
+		claimed.PagesFetched, claimed.StatusesFetched, claimed.OldestId, claimed.NextPageUrl = 2, 40, "100", "https://"+testHost+"/outbox?page=3"
+		must(t, s.UpdateBackfillJobProgress(claimed))
+		must(t, s.FinishBackfillJob(claimed.Id, BackfillFailed, "boom"))
+		job, err := s.SelectBackfillJob(claimed.Id)
+		must(t, err)
+		if job.State != BackfillFailed || job.LastError != "boom" || job.PagesFetched != 2 || job.StatusesFetched != 40 || job.NextPageUrl != claimed.NextPageUrl || job.FinishedAt.IsZero() {
+			t.Errorf("finished job = %+v", job)
+		}
+		// 他のアカウントや、fromに含まれない状態からは変わらない
+		must(t, s.TransitionBackfillJob(second.Id, "2", testHost, BackfillCanceled, BackfillQueued))
+		must(t, s.TransitionBackfillJob(second.Id, "1", testHost, BackfillCanceled, BackfillRunning))
+		job, err = s.SelectBackfillJob(second.Id)
+		must(t, err)
+		if job.State != BackfillQueued {
+			t.Errorf("state = %s, want unchanged", job.State)
+		}
+		must(t, s.TransitionBackfillJob(second.Id, "1", testHost, BackfillPaused, BackfillQueued, BackfillRunning))
+		if _, ok, err := s.ClaimBackfillJob(); err != nil || ok {
+			t.Errorf("claimed a paused job: %v, %v", ok, err)
+		}
+		must(t, s.TransitionBackfillJob(second.Id, "1", testHost, BackfillQueued, BackfillPaused))
+		_, ok, err = s.ClaimBackfillJob()
+		must(t, err)
+		if !ok {
+			t.Fatal("no job to claim")
+		}
+		must(t, s.RequeueRunningBackfillJobs())
+		job, err = s.SelectBackfillJob(second.Id)
+		must(t, err)
+		if job.State != BackfillQueued {
+			t.Errorf("state after requeue = %s", job.State)
+		}
+	}},
+	{"personal access tokens", func(t *testing.T, s Store) {
+		now := time.Now().UTC().Truncate(time.Second)
+		token := PersonalAccessToken{AccountId: "1", Host: testHost, Name: "cli", TokenHash: "hash1", CreatedAt: now}
+		other := PersonalAccessToken{AccountId: "2", Host: testHost, Name: "cli", TokenHash: "hash2", CreatedAt: now}
+		must(t, s.InsertPersonalAccessToken(&token))
+		must(t, s.InsertPersonalAccessToken(&other))
+		if err := s.InsertPersonalAccessToken(&PersonalAccessToken{AccountId: "1", Host: testHost, TokenHash: "hash1", CreatedAt: now}); err == nil {
+			t.Error("inserted a duplicate token hash")
+		}
+		tokens, err := s.SelectPersonalAccessTokens("1", testHost)
+		must(t, err)
+		if len(tokens) != 1 || tokens[0].Id != token.Id || !tokens[0].LastUsedAt.IsZero() {
+			t.Errorf("tokens = %+v", tokens)
+		}
+		must(t, s.UpdatePersonalAccessTokenLastUsed(token.Id, now))
+		found, ok, err := s.SelectPersonalAccessTokenByHash("hash1")
+		must(t, err)
+		if !ok || found.Id != token.Id || !found.LastUsedAt.Equal(now) {
+			t.Errorf("token by hash = %+v, %v", found, ok)
+		}
+		// 他のアカウントのトークンは消えない
+		must(t, s.DeletePersonalAccessToken(other.Id, "1", testHost))
+		must(t, s.DeletePersonalAccessToken(token.Id, "1", testHost))
+		if _, ok, err := s.SelectPersonalAccessTokenByHash("hash1"); err != nil || ok {
+			t.Errorf("deleted token = %v, %v", ok, err)
+		}
+		if _, ok, err := s.SelectPersonalAccessTokenByHash("hash2"); err != nil || !ok {
+			t.Errorf("other token = %v, %v", ok, err)
+		}
+	}},
+	{"instance actor", func(t *testing.T, s Store) {
+		if _, ok, err := s.SelectInstanceActor(); err != nil || ok {
+			t.Errorf("actor before insert = %v, %v", ok, err)
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		must(t, s.InsertInstanceActorIfNotExists(InstanceActor{Id: instanceActorId, PrivateKey: "first", CreatedAt: now}))
+		must(t, s.InsertInstanceActorIfNotExists(InstanceActor{Id: instanceActorId, PrivateKey: "second", CreatedAt: now}))
+		actor, ok, err := s.SelectInstanceActor()
+		must(t, err)
+		if !ok || actor.PrivateKey != "first" {
+			t.Errorf("actor = %+v, %v", actor, ok)
+		}
+	}},
+}
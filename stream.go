@@ -0,0 +1,211 @@
+package activitypublog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// 無通信がこれより続いたら切れたとみなす。Mastodonは十数秒ごとにコメント行を送ってくる
+const streamIdleTimeout = time.Minute * 2
+
+// これより長くつながっていたら、次の再接続の待ち時間を最初からにする
+const streamStableDuration = time.Minute * 5
+
+// 環境変数STREAMINGがoffならストリーミングを使わず、定期同期だけにする
+func StreamingEnabled() bool {
+	return os.Getenv("STREAMING") != "off"
+}
+
+type streamEvent struct {
+	Event string
+	Data  string
+}
+
+// SSEを読み、イベントごとにhandleを呼ぶ。1行読むたびにaliveを呼ぶ
+// 接続が切れたらio.EOFを返す
+func readStreamEvents(r io.Reader, alive func(), handle func(streamEvent) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	var event streamEvent
+	var data []string
+	for scanner.Scan() {
+		alive()
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event.Event != "" || len(data) > 0 {
+				event.Data = strings.Join(data, "\n")
+				if err := handle(event); err != nil {
+					return err
+				}
+			}
+			event = streamEvent{}
+			data = nil
+		case strings.HasPrefix(line, ":"):
+			// ハートビート
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event.Event = value
+			case "data":
+				data = append(data, value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// userストリームにはフォローしている人の投稿も流れてくるので、自分の投稿だけを取り込む
+func handleStreamEvent(ctx context.Context, credential Credential, event streamEvent) error {
+	switch event.Event {
+	case "update", "status.update":
+		var v hStatus
+		if err := json.Unmarshal([]byte(event.Data), &v); err != nil {
+			return fmt.Errorf("failed to parse %s event: %v", event.Event, err)
+		}
+		if v.Account.Id != credential.AccountId {
+			return nil
+		}
+		s, ok := v.toStatus(credential.Host, credential.AccountId)
+		if !ok {
+			return nil
+		}
+		_, err := ingestStatuses(ctx, []Status{s}, credential.AccountId, credential.Host, credential.AccessToken)
+		return err
+	case "delete":
+		// deleteのdataは投稿のidそのもの。自分の投稿でなければ何も変わらない
+		_, err := store.MarkStatusesDeleted(credential.AccountId, credential.Host, []string{event.Data}, time.Now().UTC())
+		return err
+	}
+	return nil
+}
+
+// 1回接続して、切れるまでイベントを取り込む
+// 接続してから切れていた間の投稿をRESTで取り込むので、再接続のたびに抜けが埋まる
+func streamOnce(ctx context.Context, credential Credential) error {
+	baseUrl, err := hGetStreamingBaseUrl(ctx, credential.Host)
+	if err != nil {
+		return err
+	}
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	body, err := hOpenUserStream(connCtx, baseUrl, credential.AccessToken)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if _, err := syncNewerStatuses(ctx, credential.Host, credential.AccessToken, credential.AccountId); err != nil {
+		return err
+	}
+	idle := time.AfterFunc(streamIdleTimeout, cancel)
+	defer idle.Stop()
+	return readStreamEvents(body, func() { idle.Reset(streamIdleTimeout) }, func(event streamEvent) error {
+		return handleStreamEvent(ctx, credential, event)
+	})
+}
+
+// ctxがキャンセルされるか、トークンが無効になるまで再接続し続ける
+func streamAccount(ctx context.Context, credential Credential) error {
+	attempt := 0
+	for {
+		connectedAt := time.Now()
+		err := streamOnce(ctx, credential)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrUnauthorized) {
+			return err
+		}
+		if time.Since(connectedAt) > streamStableDuration {
+			attempt = 0
+		}
+		fmt.Printf("streaming: %s@%s: %v\n", credential.AccountId, credential.Host, err)
+		if err := sleepContext(ctx, mastodon.backoff(attempt, nil, time.Now())); err != nil {
+			return err
+		}
+		attempt++
+	}
+}
+
+type streamKey struct {
+	AccountId string
+	Host      string
+}
+
+type runningStream struct {
+	token  string
+	cancel context.CancelFunc
+}
+
+type streamResult struct {
+	key   streamKey
+	token string
+	err   error
+}
+
+// 資格情報のあるアカウントごとにストリーミングを張る。tickごとに資格情報を読み直し、トークンが変わったらつなぎ直す
+// トークンが無効だったアカウントは、ログインし直してトークンが変わるまでつながない
+func StartStreaming(ctx context.Context, tick time.Duration) {
+	running := map[streamKey]runningStream{}
+	revoked := map[streamKey]string{}
+	done := make(chan streamResult)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		credentials, err := store.SelectCredentials()
+		if err != nil {
+			fmt.Printf("streaming: %v\n", err)
+		}
+		for _, credential := range credentials {
+			// Misskeyのストリーミングは仕組みが違うので、定期同期だけにする
+			if adapter, err := serverAdapter(credential.Host); err != nil || adapter.Software() != SoftwareMastodon {
+				continue
+			}
+			key := streamKey{AccountId: credential.AccountId, Host: credential.Host}
+			if r, ok := running[key]; ok {
+				if r.token == credential.AccessToken {
+					continue
+				}
+				r.cancel()
+			}
+			if revoked[key] == credential.AccessToken {
+				continue
+			}
+			streamCtx, cancel := context.WithCancel(ctx)
+			running[key] = runningStream{token: credential.AccessToken, cancel: cancel}
+			go func(credential Credential) {
+				done <- streamResult{key: key, token: credential.AccessToken, err: streamAccount(streamCtx, credential)}
+			}(credential)
+		}
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case result := <-done:
+				if r, ok := running[result.key]; ok && r.token == result.token {
+					r.cancel()
+					delete(running, result.key)
+				}
+				if errors.Is(result.err, ErrUnauthorized) {
+					fmt.Printf("streaming: %s@%s: %v\n", result.key.AccountId, result.key.Host, result.err)
+					revoked[result.key] = result.token
+				}
+			case <-ticker.C:
+				break wait
+			}
+		}
+	}
+}
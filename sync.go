@@ -0,0 +1,107 @@
+package activitypublog
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSyncIntervalMinutes = 60
+
+// 新規ログイン時に作られるスケジュールの同期間隔（分）
+func DefaultSyncIntervalMinutes() int {
+	v, err := strconv.Atoi(os.Getenv("SYNC_INTERVAL_MINUTES"))
+	if err != nil || v <= 0 {
+		return defaultSyncIntervalMinutes
+	}
+	return v
+}
+
+// 保存済みの最新投稿より新しい投稿を取得して保存する
+func syncNewerStatuses(ctx context.Context, host string, token string, accountId string) (IngestResult, error) {
+	adapter, err := serverAdapter(host)
+	if err != nil {
+		return IngestResult{}, err
+	}
+	newestStatusId, err := store.SelectNewestStatusIdByAccount(accountId)
+	if err != nil {
+		return IngestResult{}, err
+	}
+	newStatuses, err := adapter.StatusesNewerThan(ctx, host, token, accountId, newestStatusId)
+	if err != nil {
+		return IngestResult{}, err
+	}
+	return ingestStatuses(ctx, newStatuses, accountId, host, token)
+}
+
+// 間隔にその1割までのゆらぎを足して、同じ間隔のアカウントが同時に動かないようにする
+func nextSyncRunAt(now time.Time, intervalMinutes int) time.Time {
+	interval := time.Duration(intervalMinutes) * time.Minute
+	jitter := time.Duration(rand.Int63n(int64(interval)/10 + 1))
+	return now.Add(interval + jitter)
+}
+
+func runSyncSchedule(ctx context.Context, schedule SyncSchedule) SyncSchedule {
+	now := time.Now().UTC()
+	schedule.LastRunAt = now
+	schedule.NextRunAt = nextSyncRunAt(now, schedule.IntervalMinutes)
+	schedule.LastError = ""
+	schedule.LastFetched = 0
+
+	credential, err := store.SelectCredential(schedule.AccountId, schedule.Host)
+	if err != nil {
+		schedule.LastError = err.Error()
+		return schedule
+	}
+	result, err := syncNewerStatuses(ctx, schedule.Host, credential.AccessToken, schedule.AccountId)
+	var errs []string
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	// お気に入り・ブックマークも同じタイミングで取り込む。Misskeyには同じAPIがないので取り込まない
+	var savedKinds []string
+	if adapter, err := serverAdapter(schedule.Host); err == nil && adapter.Software() == SoftwareMastodon {
+		savedKinds = []string{SavedKindFavourite, SavedKindBookmark}
+	}
+	for _, kind := range savedKinds {
+		if _, err := syncSavedStatuses(ctx, schedule.Host, credential.AccessToken, schedule.AccountId, kind); err != nil {
+			errs = append(errs, kind+": "+err.Error())
+		}
+	}
+	schedule.LastError = strings.Join(errs, "; ")
+	schedule.LastFetched = int64(result.Inserted)
+	return schedule
+}
+
+// 期限が来たアカウントを順番に同期する。ctxがキャンセルされるまで戻らない
+func StartSyncScheduler(ctx context.Context, tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		schedules, err := store.SelectDueSyncSchedules(time.Now())
+		if err != nil {
+			fmt.Printf("sync scheduler: %v\n", err)
+		}
+		for _, schedule := range schedules {
+			if ctx.Err() != nil {
+				return
+			}
+			result := runSyncSchedule(ctx, schedule)
+			if result.LastError != "" {
+				fmt.Printf("sync scheduler: %s@%s: %s\n", result.AccountId, result.Host, result.LastError)
+			}
+			if err := store.UpdateSyncScheduleResult(result); err != nil {
+				fmt.Printf("sync scheduler: %v\n", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
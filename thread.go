@@ -0,0 +1,103 @@
+package activitypublog
+
+import "sort"
+
+func visibleIn(status Status, visibilities []string) bool {
+	if visibilities == nil {
+		return true
+	}
+	for _, v := range visibilities {
+		if status.Visibility == v {
+			return true
+		}
+	}
+	return false
+}
+
+// idの投稿を含む自分のスレッドを古い順に返す。投稿が見つからなければokはfalse
+// 自分への返信をたどって根まで戻り、そこから自分の返信を下っていく
+func buildThread(accountId string, host string, id string, visibilities []string, filter StatusFilter) ([]Status, bool, error) {
+	status, ok, err := store.SelectStatus(id, host)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	if status.AccountId != accountId || !visibleIn(status, visibilities) || !filter.allows(status) {
+		return nil, false, nil
+	}
+	root := status
+	seen := map[string]bool{root.Id: true}
+	for root.InReplyToId != "" && root.InReplyToAccountId == accountId {
+		parent, ok, err := store.SelectStatus(root.InReplyToId, host)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok || seen[parent.Id] || !visibleIn(parent, visibilities) || !filter.allows(parent) {
+			break
+		}
+		seen[parent.Id] = true
+		root = parent
+	}
+
+	thread := []Status{root}
+	added := map[string]bool{root.Id: true}
+	frontier := []string{root.Id}
+	for len(frontier) > 0 {
+		replies, err := store.SelectSelfReplies(accountId, host, frontier, visibilities, filter)
+		if err != nil {
+			return nil, false, err
+		}
+		frontier = nil
+		for _, r := range replies {
+			if added[r.Id] {
+				continue
+			}
+			added[r.Id] = true
+			thread = append(thread, r)
+			frontier = append(frontier, r.Id)
+		}
+	}
+	sort.SliceStable(thread, func(i, j int) bool { return thread[i].CreatedAt.Before(thread[j].CreatedAt) })
+	return thread, true, nil
+}
+
+// 一覧のうち、同じ一覧にある自分の投稿への返信を根の投稿にまとめる
+func collapseThreads(statuses []Status, accountId string) []Status {
+	parents := make(map[string]string, len(statuses))
+	for _, s := range statuses {
+		if s.InReplyToId != "" && s.InReplyToAccountId == accountId {
+			parents[s.Id] = s.InReplyToId
+		}
+	}
+	listed := make(map[string]bool, len(statuses))
+	for _, s := range statuses {
+		listed[s.Id] = true
+	}
+	sizes := map[string]int{}
+	var collapsed []Status
+	for _, s := range statuses {
+		root := s.Id
+		for depth := 0; depth < len(statuses); depth++ {
+			parent, ok := parents[root]
+			if !ok || !listed[parent] {
+				break
+			}
+			root = parent
+		}
+		if root != s.Id {
+			sizes[root]++
+			continue
+		}
+		collapsed = append(collapsed, s)
+	}
+	for i, s := range collapsed {
+		collapsed[i].ThreadSize = sizes[s.Id]
+	}
+	return collapsed
+}
+
+func withBasePath(statuses []Status, basePath string) []Status {
+	for i := range statuses {
+		statuses[i].BasePath = basePath
+	}
+	return statuses
+}